@@ -1,9 +1,39 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"iter"
+	"math"
+	"math/big"
+	"math/rand"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
 )
 
 // FilterSet is a function that applies a set of filters and returns the filtered records.
@@ -15,12 +45,40 @@ type Filter func(string) bool
 // FilterBulk is a bulk filter function applied to an entire slice of records.
 type FilterBulk func([]string) []string
 
-var filters = map[int]FilterSet{
-	1: FilterForAnimals,
-	2: FilterForIDs,
+// NamedFilter is a filter function paired with a name for reporting.
+// Priority decides which filter is blamed when several reject the same record, higher wins.
+type NamedFilter struct {
+	Name     string
+	Filter   Filter
+	Priority int
+}
+
+// Mapper is a transform function applied to a single record.
+type Mapper func(string) string
+
+// ParseFilter is a filter function that also rewrites the record to its canonical form.
+// It returns false if the record should be removed.
+type ParseFilter func(string) (string, bool)
+
+// Middleware wraps a filter with additional behavior, e.g. logging or caching.
+type Middleware func(Filter) Filter
+
+var filters = map[string]FilterSet{
+	"animals": FilterForAnimals,
+	"ids":     FilterForIDs,
 }
 
 func main() {
+	list := flag.Bool("list", false, "list the available filter sets and exit")
+	flag.Parse()
+
+	if *list {
+		for _, name := range ListFilterSets() {
+			fmt.Println(name)
+		}
+		return
+	}
+
 	// Initialize some contrived records.
 	records := []string{
 		"Cat",
@@ -34,8 +92,8 @@ func main() {
 
 	// Call the filter functions.
 	// ApplyFilters will be applied first, in order from top to bottom.
-	animals := filters[1](records)
-	ids := filters[2](records)
+	animals := filters["animals"](records)
+	ids := filters["ids"](records)
 
 	// The only thing that should be left is one record of "Cat".
 	fmt.Println("Animals:")
@@ -104,6 +162,17 @@ func ApplyFilters(records []string, filters ...Filter) []string {
 	return filteredRecords
 }
 
+// passesFilters reports whether a single record passes every filter, in order.
+func passesFilters(record string, filters ...Filter) bool {
+	for _, f := range filters {
+		if !f(record) {
+			return false
+		}
+	}
+
+	return true
+}
+
 // ApplyBulkFilters applies a set of filters to the entire slice of records.
 // Used when each record filter requires knowledge of the other records, e.g. de-duping.
 func ApplyBulkFilters(records []string, filters ...FilterBulk) []string {
@@ -114,6 +183,21 @@ func ApplyBulkFilters(records []string, filters ...FilterBulk) []string {
 	return records
 }
 
+// ApplyMappers transforms each record through a set of mappers.
+// The mappers are applied in the order they are passed in.
+func ApplyMappers(records []string, mappers ...Mapper) []string {
+	mappedRecords := make([]string, 0, len(records))
+
+	for _, r := range records {
+		for _, m := range mappers {
+			r = m(r)
+		}
+		mappedRecords = append(mappedRecords, r)
+	}
+
+	return mappedRecords
+}
+
 // FilterDuplicates is a bulk filter to remove any duplicates from the set.
 func FilterDuplicates(records []string) []string {
 	recordMap := map[string]bool{}
@@ -192,3 +276,2705 @@ func FilterIDs(record string) bool {
 
 	return true
 }
+
+// FilterStreamIO reads newline-delimited records from r, applies a set of filters to each record,
+// and writes the records that pass to w line by line as they are read.
+// Lines may be any length, and a trailing carriage return is removed from each record.
+func FilterStreamIO(r io.Reader, w io.Writer, filters ...Filter) error {
+	reader := bufio.NewReader(r)
+	writer := bufio.NewWriter(w)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line == "" && err == io.EOF {
+			return nil
+		}
+
+		record := strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if passesFilters(record, filters...) {
+			if _, err := writer.WriteString(record + "\n"); err != nil {
+				return err
+			}
+			// Flush after every record so downstream readers see output immediately.
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// SymmetricDifference returns the records kept by exactly one of the two filter sets.
+// Records are returned once each, in the order they first appear in the input.
+func SymmetricDifference(records []string, a, b FilterSet) []string {
+	inA := toSet(a(records))
+	inB := toSet(b(records))
+	seen := map[string]bool{}
+	filteredRecords := []string{}
+
+	for _, r := range records {
+		if seen[r] || inA[r] == inB[r] {
+			continue
+		}
+		seen[r] = true
+		filteredRecords = append(filteredRecords, r)
+	}
+
+	return filteredRecords
+}
+
+// toSet builds a lookup set from a slice of records.
+func toSet(records []string) map[string]bool {
+	set := make(map[string]bool, len(records))
+	for _, r := range records {
+		set[r] = true
+	}
+
+	return set
+}
+
+// FilterControlChars removes any records containing control characters.
+// If allowWhitespace is true, tabs and newlines are not treated as control characters.
+func FilterControlChars(allowWhitespace bool) Filter {
+	return func(record string) bool {
+		for _, r := range record {
+			if allowWhitespace && (r == '\t' || r == '\n') {
+				continue
+			}
+			if unicode.IsControl(r) {
+				return false
+			}
+		}
+
+		return true
+	}
+}
+
+// Classify applies each filter set to the records and returns the results keyed by set name.
+func Classify(records []string, sets map[string]FilterSet) map[string][]string {
+	results := make(map[string][]string, len(sets))
+	for name, fs := range sets {
+		results[name] = fs(records)
+	}
+
+	return results
+}
+
+// ClassifyParallel is like Classify, but applies each filter set in its own goroutine.
+// Filter sets must not modify the records they are passed.
+func ClassifyParallel(records []string, sets map[string]FilterSet) map[string][]string {
+	results := make(map[string][]string, len(sets))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, fs := range sets {
+		wg.Add(1)
+		go func(name string, fs FilterSet) {
+			defer wg.Done()
+
+			filtered := fs(records)
+
+			mu.Lock()
+			results[name] = filtered
+			mu.Unlock()
+		}(name, fs)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// FilterMonotonic is a bulk filter that keeps only records forming a strictly increasing sequence.
+// Each record is parsed with parse, and unparseable records are removed.
+func FilterMonotonic(parse func(string) (int, bool)) FilterBulk {
+	return func(records []string) []string {
+		filteredRecords := []string{}
+		started := false
+		last := 0
+
+		for _, record := range records {
+			v, ok := parse(record)
+			if !ok {
+				continue
+			}
+			if started && v <= last {
+				continue
+			}
+			started = true
+			last = v
+			filteredRecords = append(filteredRecords, record)
+		}
+
+		return filteredRecords
+	}
+}
+
+// WriteCSV writes the columns to w as CSV, with the column names as the header row.
+// Columns are sorted by name, and shorter columns are padded with empty cells.
+func WriteCSV(w io.Writer, columns map[string][]string) error {
+	headers := make([]string, 0, len(columns))
+	rows := 0
+	for name, records := range columns {
+		headers = append(headers, name)
+		if len(records) > rows {
+			rows = len(records)
+		}
+	}
+	sort.Strings(headers)
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(headers); err != nil {
+		return err
+	}
+
+	for i := 0; i < rows; i++ {
+		row := make([]string, len(headers))
+		for j, name := range headers {
+			if i < len(columns[name]) {
+				row[j] = columns[name][i]
+			}
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// SuffixDuplicates is a bulk filter that renames repeated records instead of removing them.
+// The first occurrence is left untouched, and later occurrences have sep and their occurrence number appended.
+// Numbers that would produce a record already in the batch are skipped, so renaming never creates a duplicate.
+func SuffixDuplicates(sep string) FilterBulk {
+	return func(records []string) []string {
+		taken := toSet(records)
+		seen := map[string]bool{}
+		next := map[string]int{}
+		filteredRecords := make([]string, 0, len(records))
+
+		for _, record := range records {
+			if !seen[record] {
+				seen[record] = true
+				next[record] = 2
+				filteredRecords = append(filteredRecords, record)
+				continue
+			}
+
+			n := next[record]
+			for taken[record+sep+strconv.Itoa(n)] {
+				n++
+			}
+			next[record] = n + 1
+
+			renamed := record + sep + strconv.Itoa(n)
+			taken[renamed] = true
+			filteredRecords = append(filteredRecords, renamed)
+		}
+
+		return filteredRecords
+	}
+}
+
+// SplitRecords is a bulk filter that splits each record on sep into multiple records.
+// Empty fragments are removed.
+func SplitRecords(sep string) FilterBulk {
+	return func(records []string) []string {
+		filteredRecords := make([]string, 0, len(records))
+
+		for _, record := range records {
+			for _, fragment := range strings.Split(record, sep) {
+				if fragment == "" {
+					continue
+				}
+				filteredRecords = append(filteredRecords, fragment)
+			}
+		}
+
+		return filteredRecords
+	}
+}
+
+// RejectBatchIf is a bulk filter that removes every record if any single record fails f.
+// Otherwise the records are returned unchanged.
+func RejectBatchIf(f Filter) FilterBulk {
+	return func(records []string) []string {
+		for _, record := range records {
+			if !f(record) {
+				return []string{}
+			}
+		}
+
+		return records
+	}
+}
+
+// FilterDuplicatesWithCounts removes any duplicates from the set and reports how often each record appeared.
+// counts[i] is the number of times unique[i] appeared in records.
+func FilterDuplicatesWithCounts(records []string) (unique []string, counts []int) {
+	index := map[string]int{}
+	unique = []string{}
+	counts = []int{}
+
+	for _, record := range records {
+		if i, ok := index[record]; ok {
+			counts[i]++
+			continue
+		}
+		index[record] = len(unique)
+		unique = append(unique, record)
+		counts = append(counts, 1)
+	}
+
+	return unique, counts
+}
+
+// FilterIP removes any records that aren't IP addresses.
+// A version of 4 or 6 only keeps addresses of that version, any other version keeps both.
+// IPv4-mapped IPv6 addresses like "::ffff:1.2.3.4" are written as IPv6, so they count as version 6.
+// Zoned addresses like "fe80::1%eth0" are removed.
+func FilterIP(version int) Filter {
+	return func(record string) bool {
+		ip := net.ParseIP(record)
+		if ip == nil {
+			return false
+		}
+
+		// To4 also accepts IPv4-mapped addresses, so only records written without colons are IPv4.
+		is4 := ip.To4() != nil && !strings.Contains(record, ":")
+
+		switch version {
+		case 4:
+			return is4
+		case 6:
+			return !is4
+		}
+
+		return true
+	}
+}
+
+// CollapseByClass keeps a single representative of the records kept by classifier.
+// The classifier is applied once to the whole batch, and every record it keeps is a member of the class.
+// The first member in input order is kept, later members are removed, and non-members are left untouched.
+func CollapseByClass(records []string, classifier FilterSet) []string {
+	class := toSet(classifier(records))
+	filteredRecords := make([]string, 0, len(records))
+	represented := false
+
+	for _, r := range records {
+		if class[r] {
+			if represented {
+				continue
+			}
+			represented = true
+		}
+		filteredRecords = append(filteredRecords, r)
+	}
+
+	return filteredRecords
+}
+
+// Decision is the verdict of a single named filter on a record.
+type Decision struct {
+	Name string
+	Kept bool
+}
+
+// Explain reports the verdict of each filter on a single record.
+// Unlike ApplyFilters, every filter is evaluated even after one has failed.
+func Explain(record string, filters ...NamedFilter) []Decision {
+	decisions := make([]Decision, 0, len(filters))
+	for _, f := range filters {
+		decisions = append(decisions, Decision{Name: f.Name, Kept: f.Filter(record)})
+	}
+
+	return decisions
+}
+
+// RequireMinCount returns a bulk stage that errors if there are fewer than min records.
+// Otherwise the records are returned unchanged.
+func RequireMinCount(min int) func([]string) ([]string, error) {
+	return func(records []string) ([]string, error) {
+		if len(records) < min {
+			return nil, fmt.Errorf("expected at least %d records, got %d", min, len(records))
+		}
+
+		return records, nil
+	}
+}
+
+// FilterHostname removes any records that aren't valid RFC 1123 hostnames.
+func FilterHostname() Filter {
+	return func(record string) bool {
+		if len(record) == 0 || len(record) > 253 {
+			return false
+		}
+
+		for _, label := range strings.Split(record, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return false
+			}
+			if label[0] == '-' || label[len(label)-1] == '-' {
+				return false
+			}
+
+			for _, c := range label {
+				isAlnum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+				if !isAlnum && c != '-' {
+					return false
+				}
+			}
+		}
+
+		return true
+	}
+}
+
+// FilterWeightedSample is a bulk filter that randomly keeps records based on their frequency in the batch.
+// Each record is kept with probability weight(record, freq), clamped to [0, 1].
+func FilterWeightedSample(weight func(record string, freq int) float64, rng *rand.Rand) FilterBulk {
+	return func(records []string) []string {
+		freqs := map[string]int{}
+		for _, record := range records {
+			freqs[record]++
+		}
+
+		filteredRecords := []string{}
+		for _, record := range records {
+			p := math.Max(0, math.Min(1, weight(record, freqs[record])))
+			if rng.Float64() < p {
+				filteredRecords = append(filteredRecords, record)
+			}
+		}
+
+		return filteredRecords
+	}
+}
+
+// ListFilterSets returns the sorted names of all the registered filter sets.
+func ListFilterSets() []string {
+	names := make([]string, 0, len(filters))
+	for name := range filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// RequireGrouped returns a bulk stage that errors if records sharing a key aren't contiguous.
+// Otherwise the records are returned unchanged.
+func RequireGrouped(key func(string) string) func([]string) ([]string, error) {
+	return func(records []string) ([]string, error) {
+		closed := map[string]bool{}
+		current := ""
+
+		for i, record := range records {
+			k := key(record)
+			if i > 0 && k == current {
+				continue
+			}
+			if closed[k] {
+				return nil, fmt.Errorf("key %q at record %d is not contiguous with its group", k, i)
+			}
+			if i > 0 {
+				closed[current] = true
+			}
+			current = k
+		}
+
+		return records, nil
+	}
+}
+
+// FilterValidUTF8 removes any records that aren't valid UTF-8.
+func FilterValidUTF8() Filter {
+	return func(record string) bool {
+		return utf8.ValidString(record)
+	}
+}
+
+// FilterLengthOutliers is a bulk filter that removes records with unusual lengths for the batch.
+// A record is removed if its length is more than maxStdDev standard deviations from the mean length.
+func FilterLengthOutliers(maxStdDev float64) FilterBulk {
+	return func(records []string) []string {
+		if len(records) == 0 {
+			return records
+		}
+
+		var sum float64
+		for _, record := range records {
+			sum += float64(len(record))
+		}
+		mean := sum / float64(len(records))
+
+		var variance float64
+		for _, record := range records {
+			d := float64(len(record)) - mean
+			variance += d * d
+		}
+		stdDev := math.Sqrt(variance / float64(len(records)))
+
+		filteredRecords := []string{}
+		for _, record := range records {
+			if math.Abs(float64(len(record))-mean) > maxStdDev*stdDev {
+				continue
+			}
+			filteredRecords = append(filteredRecords, record)
+		}
+
+		return filteredRecords
+	}
+}
+
+// ApplyFiltersPriority applies a set of named filters to a record list like ApplyFilters,
+// and counts the rejected records by the filter blamed for each.
+// A rejected record is blamed on its highest priority failing filter, with ties going to the earlier filter.
+func ApplyFiltersPriority(records []string, filters []NamedFilter) ([]string, map[string]int) {
+	filteredRecords := make([]string, 0, len(records))
+	rejections := map[string]int{}
+
+	for _, r := range records {
+		failed := -1
+		for i, f := range filters {
+			if !f.Filter(r) {
+				failed = i
+				break
+			}
+		}
+
+		if failed < 0 {
+			filteredRecords = append(filteredRecords, r)
+			continue
+		}
+
+		// The record is already rejected, so only the remaining filters can change the blame.
+		blamed := filters[failed]
+		for _, f := range filters[failed+1:] {
+			if f.Priority > blamed.Priority && !f.Filter(r) {
+				blamed = f
+			}
+		}
+		rejections[blamed.Name]++
+	}
+
+	return filteredRecords, rejections
+}
+
+// StatefulDeduper removes duplicates across sequential batches of records.
+// Records seen in an earlier batch are removed from later batches until Reset is called.
+type StatefulDeduper struct {
+	maxSize int
+	seen    map[string]bool
+	order   []string
+}
+
+// NewStatefulDeduper returns a deduper that remembers at most maxSize records, evicting the oldest first.
+// A maxSize of 0 or less remembers every record.
+func NewStatefulDeduper(maxSize int) *StatefulDeduper {
+	return &StatefulDeduper{
+		maxSize: maxSize,
+		seen:    map[string]bool{},
+	}
+}
+
+// Filter removes any records seen in this batch or a previous one.
+func (d *StatefulDeduper) Filter(records []string) []string {
+	if d.seen == nil {
+		d.seen = map[string]bool{}
+	}
+
+	filteredRecords := []string{}
+	for _, record := range records {
+		if d.seen[record] {
+			continue
+		}
+
+		if d.maxSize > 0 && len(d.order) >= d.maxSize {
+			delete(d.seen, d.order[0])
+			d.order = d.order[1:]
+		}
+		d.seen[record] = true
+		d.order = append(d.order, record)
+		filteredRecords = append(filteredRecords, record)
+	}
+
+	return filteredRecords
+}
+
+// Reset forgets every record seen so far.
+func (d *StatefulDeduper) Reset() {
+	d.seen = map[string]bool{}
+	d.order = nil
+}
+
+// FilterJSON removes any records that aren't valid JSON.
+// Any JSON value is kept, including bare numbers, strings, booleans and null.
+func FilterJSON() Filter {
+	return func(record string) bool {
+		return json.Valid([]byte(record))
+	}
+}
+
+// RequireDuplicateRatioBelow returns a bulk stage that errors if too many records are duplicates.
+// The duplicate ratio is the number of repeated records over the total, and an empty batch has a ratio of 0.
+func RequireDuplicateRatioBelow(max float64) func([]string) ([]string, error) {
+	return func(records []string) ([]string, error) {
+		if len(records) == 0 {
+			return records, nil
+		}
+
+		distinct := len(toSet(records))
+		ratio := float64(len(records)-distinct) / float64(len(records))
+		if ratio > max {
+			return nil, fmt.Errorf("duplicate ratio %.3f exceeds maximum %.3f", ratio, max)
+		}
+
+		return records, nil
+	}
+}
+
+// FilterReservoir is a bulk filter that keeps k records chosen uniformly at random in a single pass.
+// If there are k or fewer records, all of them are kept. Kept records stay in their original order.
+func FilterReservoir(k int, rng *rand.Rand) FilterBulk {
+	return func(records []string) []string {
+		if k <= 0 {
+			return []string{}
+		}
+
+		// Sample indexes rather than records so the original order can be restored.
+		reservoir := make([]int, 0, k)
+		for i := range records {
+			if len(reservoir) < k {
+				reservoir = append(reservoir, i)
+				continue
+			}
+			if j := rng.Intn(i + 1); j < k {
+				reservoir[j] = i
+			}
+		}
+		sort.Ints(reservoir)
+
+		filteredRecords := make([]string, 0, len(reservoir))
+		for _, i := range reservoir {
+			filteredRecords = append(filteredRecords, records[i])
+		}
+
+		return filteredRecords
+	}
+}
+
+// FilterSemVer removes any records that aren't semantic versions as defined by SemVer 2.0.0.
+// A leading "v" is not part of the grammar, so records like "v1.2.3" are removed.
+func FilterSemVer() Filter {
+	return func(record string) bool {
+		version, build, hasBuild := strings.Cut(record, "+")
+		if hasBuild && !validSemVerIdentifiers(build, false) {
+			return false
+		}
+
+		core, prerelease, hasPrerelease := strings.Cut(version, "-")
+		if hasPrerelease && !validSemVerIdentifiers(prerelease, true) {
+			return false
+		}
+
+		parts := strings.Split(core, ".")
+		if len(parts) != 3 {
+			return false
+		}
+		for _, p := range parts {
+			if !isSemVerNumber(p) {
+				return false
+			}
+		}
+
+		return true
+	}
+}
+
+// validSemVerIdentifiers reports whether s is a dot-separated list of SemVer identifiers.
+// Prerelease identifiers that are numeric must not have leading zeros.
+func validSemVerIdentifiers(s string, prerelease bool) bool {
+	for _, id := range strings.Split(s, ".") {
+		if id == "" {
+			return false
+		}
+
+		numeric := true
+		for _, c := range id {
+			isDigit := c >= '0' && c <= '9'
+			isLetter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+			if !isDigit && !isLetter && c != '-' {
+				return false
+			}
+			if !isDigit {
+				numeric = false
+			}
+		}
+
+		if prerelease && numeric && !isSemVerNumber(id) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isSemVerNumber reports whether s is a non-negative integer without leading zeros.
+func isSemVerNumber(s string) bool {
+	if s == "" || (len(s) > 1 && s[0] == '0') {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// FilterMaxRun is a bulk filter that keeps at most n consecutive identical records.
+// The rest of each longer run is removed, so an n of 1 removes adjacent duplicates.
+func FilterMaxRun(n int) FilterBulk {
+	return func(records []string) []string {
+		filteredRecords := []string{}
+		run := 0
+
+		for i, record := range records {
+			if i > 0 && record == records[i-1] {
+				run++
+			} else {
+				run = 1
+			}
+
+			if run <= n {
+				filteredRecords = append(filteredRecords, record)
+			}
+		}
+
+		return filteredRecords
+	}
+}
+
+// WithFallback returns a filter set that applies primary, falling back to fallback if primary removes every record.
+// The fallback is only applied when there were records to begin with.
+func WithFallback(primary, fallback FilterSet) FilterSet {
+	return func(records []string) []string {
+		filteredRecords := primary(records)
+		if len(filteredRecords) == 0 && len(records) > 0 {
+			return fallback(records)
+		}
+
+		return filteredRecords
+	}
+}
+
+// FilterCurrency removes any records that aren't currency amounts like "$1,234.56" or "€99".
+// The symbol is optional, so bare amounts are kept. If no symbols are given, "$", "€" and "£" are used.
+func FilterCurrency(symbols ...string) Filter {
+	if len(symbols) == 0 {
+		symbols = []string{"$", "€", "£"}
+	}
+
+	quoted := make([]string, 0, len(symbols))
+	for _, s := range symbols {
+		quoted = append(quoted, regexp.QuoteMeta(s))
+	}
+	re := regexp.MustCompile(`^(?:` + strings.Join(quoted, "|") + `)?(?:\d{1,3}(?:,\d{3})+|\d+)(?:\.\d+)?$`)
+
+	return func(record string) bool {
+		return re.MatchString(record)
+	}
+}
+
+// BatchChecksum returns an order-sensitive FNV-1a checksum of the records.
+// Each record is followed by a NUL separator so that, e.g., ["ab", "c"] and ["a", "bc"] differ.
+func BatchChecksum(records []string) uint64 {
+	h := fnv.New64a()
+	for _, record := range records {
+		h.Write([]byte(record))
+		h.Write([]byte{0})
+	}
+
+	return h.Sum64()
+}
+
+// ConditionalFilter returns a filter that applies ifTrue to records passing pred, and ifFalse to the rest.
+func ConditionalFilter(pred Filter, ifTrue, ifFalse Filter) Filter {
+	return func(record string) bool {
+		if pred(record) {
+			return ifTrue(record)
+		}
+
+		return ifFalse(record)
+	}
+}
+
+// FilterReferences is a bulk filter that keeps only records whose extracted key is in validKeys.
+func FilterReferences(validKeys map[string]struct{}, extractKey func(string) string) FilterBulk {
+	return func(records []string) []string {
+		filteredRecords := []string{}
+		for _, record := range records {
+			if _, ok := validKeys[extractKey(record)]; ok {
+				filteredRecords = append(filteredRecords, record)
+			}
+		}
+
+		return filteredRecords
+	}
+}
+
+// Provenance lists the names of the filter sets that kept a record.
+type Provenance struct {
+	Record string
+	Sets   []string
+}
+
+// ClassifyWithProvenance applies each filter set to the records and reports which sets kept each record.
+// Records kept by at least one set are listed once each in input order, with their set names sorted.
+func ClassifyWithProvenance(records []string, sets map[string]FilterSet) []Provenance {
+	keptBy := map[string][]string{}
+	for name, kept := range Classify(records, sets) {
+		for r := range toSet(kept) {
+			keptBy[r] = append(keptBy[r], name)
+		}
+	}
+
+	provenance := []Provenance{}
+	for _, r := range records {
+		names, ok := keptBy[r]
+		if !ok {
+			continue
+		}
+		delete(keptBy, r)
+
+		sort.Strings(names)
+		provenance = append(provenance, Provenance{Record: r, Sets: names})
+	}
+
+	return provenance
+}
+
+// FillSequenceGaps is a bulk filter that makes a numeric sequence dense by inserting placeholder(n) for each missing n.
+// Records are parsed with parse. Unparseable records are removed, and so are out-of-order records that don't
+// increase the sequence; they are dropped silently. Gaps of more than maxGap missing values are left unfilled,
+// so a single outlier like 1 followed by 1000000000 can't blow up the output. A maxGap of 0 or less means no cap,
+// filling every missing value however large the gap.
+func FillSequenceGaps(parse func(string) (int, bool), placeholder func(int) string, maxGap int) FilterBulk {
+	return func(records []string) []string {
+		filteredRecords := []string{}
+		started := false
+		last := 0
+
+		for _, record := range records {
+			v, ok := parse(record)
+			if !ok || (started && v <= last) {
+				continue
+			}
+
+			// v > last here, so the unsigned difference can't wrap even for extreme values like math.MinInt and math.MaxInt.
+			if started && (maxGap <= 0 || uint64(v)-uint64(last)-1 <= uint64(maxGap)) {
+				for n := last + 1; n < v; n++ {
+					filteredRecords = append(filteredRecords, placeholder(n))
+				}
+			}
+			started = true
+			last = v
+			filteredRecords = append(filteredRecords, record)
+		}
+
+		return filteredRecords
+	}
+}
+
+// FilterMAC removes any records that aren't MAC addresses in colon, hyphen or dotted notation.
+func FilterMAC() Filter {
+	return func(record string) bool {
+		_, err := net.ParseMAC(record)
+		return err == nil
+	}
+}
+
+// FilterHashDownsample is a bulk filter that keeps roughly the given fraction of records, chosen by hash.
+// Whether a record is kept depends only on its value, so it is the same across runs and batches.
+func FilterHashDownsample(fraction float64) FilterBulk {
+	const buckets = 1000000
+	threshold := uint64(math.Max(0, math.Min(1, fraction)) * buckets)
+
+	return func(records []string) []string {
+		filteredRecords := []string{}
+		for _, record := range records {
+			if hashRecord(record)%buckets < threshold {
+				filteredRecords = append(filteredRecords, record)
+			}
+		}
+
+		return filteredRecords
+	}
+}
+
+// Stats summarizes the durations of repeated filter set runs.
+type Stats struct {
+	Min  time.Duration
+	Max  time.Duration
+	Mean time.Duration
+	P50  time.Duration
+	P95  time.Duration
+}
+
+// Benchmark applies the filter set to the records iterations times and summarizes how long each run took.
+func Benchmark(fs FilterSet, records []string, iterations int) Stats {
+	if iterations <= 0 {
+		return Stats{}
+	}
+
+	durations := make([]time.Duration, 0, iterations)
+	var total time.Duration
+	for i := 0; i < iterations; i++ {
+		start := time.Now()
+		fs(records)
+		d := time.Since(start)
+
+		durations = append(durations, d)
+		total += d
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+	// Percentiles use the nearest-rank method.
+	percentile := func(p float64) time.Duration {
+		rank := int(math.Ceil(p / 100 * float64(len(durations))))
+		if rank < 1 {
+			rank = 1
+		}
+		return durations[rank-1]
+	}
+
+	return Stats{
+		Min:  durations[0],
+		Max:  durations[len(durations)-1],
+		Mean: total / time.Duration(len(durations)),
+		P50:  percentile(50),
+		P95:  percentile(95),
+	}
+}
+
+// RequireExactlyOne returns a bulk stage that errors unless every record matches exactly one of the validators.
+// Otherwise the records are returned unchanged.
+func RequireExactlyOne(validators map[string]Filter) func([]string) ([]string, error) {
+	names := make([]string, 0, len(validators))
+	for name := range validators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return func(records []string) ([]string, error) {
+		for _, record := range records {
+			matched := []string{}
+			for _, name := range names {
+				if validators[name](record) {
+					matched = append(matched, name)
+				}
+			}
+
+			if len(matched) != 1 {
+				return nil, fmt.Errorf("record %q matched %d validators, expected exactly 1: %v", record, len(matched), matched)
+			}
+		}
+
+		return records, nil
+	}
+}
+
+// ApplyFiltersBytes is like ApplyFilters, but for records held as byte slices.
+// It avoids converting each record to a string.
+func ApplyFiltersBytes(records [][]byte, filters ...func([]byte) bool) [][]byte {
+	if len(filters) == 0 {
+		return records
+	}
+
+	filteredRecords := make([][]byte, 0, len(records))
+
+	for _, r := range records {
+		keep := true
+
+		for _, f := range filters {
+			if !f(r) {
+				keep = false
+				break
+			}
+		}
+
+		if keep {
+			filteredRecords = append(filteredRecords, r)
+		}
+	}
+
+	return filteredRecords
+}
+
+// FilterStringLengthBytes is the byte slice version of FilterStringLength.
+func FilterStringLengthBytes(record []byte) bool {
+	return len(record) <= 75
+}
+
+// FilterWordsBytes is the byte slice version of FilterWords.
+func FilterWordsBytes(record []byte) bool {
+	return bytes.IndexByte(record, ' ') < 0
+}
+
+// FilterDedupByJSONField is a bulk filter that keeps the first JSON object record for each distinct value of field.
+// Records that aren't JSON objects, or that don't have the field, are removed.
+func FilterDedupByJSONField(field string) FilterBulk {
+	return func(records []string) []string {
+		seen := map[string]bool{}
+		filteredRecords := []string{}
+
+		for _, record := range records {
+			var object map[string]json.RawMessage
+			if err := json.Unmarshal([]byte(record), &object); err != nil {
+				continue
+			}
+			raw, ok := object[field]
+			if !ok {
+				continue
+			}
+
+			// Compact the raw value so formatting differences don't make equal values distinct.
+			var key bytes.Buffer
+			if err := json.Compact(&key, raw); err != nil {
+				continue
+			}
+			if seen[key.String()] {
+				continue
+			}
+			seen[key.String()] = true
+			filteredRecords = append(filteredRecords, record)
+		}
+
+		return filteredRecords
+	}
+}
+
+// EvalMode controls how many filters ApplyFiltersMode runs on a record.
+type EvalMode int
+
+const (
+	// ShortCircuit stops at the first filter that rejects a record.
+	ShortCircuit EvalMode = iota
+	// EvaluateAll runs every filter on every record.
+	EvaluateAll
+)
+
+// ApplyFiltersMode applies a set of named filters to a record list like ApplyFilters,
+// and reports the names of the filters that rejected each record.
+// In ShortCircuit mode only the first rejecting filter is reported, in EvaluateAll mode all of them are.
+func ApplyFiltersMode(records []string, mode EvalMode, filters ...NamedFilter) (kept []string, failures map[string][]string) {
+	kept = make([]string, 0, len(records))
+	failures = map[string][]string{}
+
+	for _, r := range records {
+		var failed []string
+
+		for _, f := range filters {
+			if f.Filter(r) {
+				continue
+			}
+			failed = append(failed, f.Name)
+			if mode == ShortCircuit {
+				break
+			}
+		}
+
+		if len(failed) > 0 {
+			failures[r] = failed
+			continue
+		}
+		kept = append(kept, r)
+	}
+
+	return kept, failures
+}
+
+// NormalizePhones is a bulk filter that rewrites phone number records to an E.164-style "+<digits>" form.
+// Numbers without a leading "+" or "00" are treated as national numbers: a single leading trunk "0" is removed,
+// the rest must be exactly 10 digits as in NANP, and defaultCountryCode is prepended. Records that don't look
+// like phone numbers, including ID-like "1234-5678" pairs and dates, are left unchanged.
+func NormalizePhones(defaultCountryCode string) FilterBulk {
+	countryCode := strings.TrimPrefix(defaultCountryCode, "+")
+
+	return func(records []string) []string {
+		filteredRecords := make([]string, 0, len(records))
+		for _, record := range records {
+			filteredRecords = append(filteredRecords, normalizePhone(record, countryCode))
+		}
+
+		return filteredRecords
+	}
+}
+
+// normalizePhone returns the E.164-style form of record, or record itself if it isn't a phone number.
+func normalizePhone(record, countryCode string) string {
+	trimmed := strings.TrimSpace(record)
+	international := strings.HasPrefix(trimmed, "+")
+
+	// Two hyphen-separated digit groups are how IDs are written, not phone numbers.
+	if parts := strings.Split(trimmed, "-"); len(parts) == 2 && isDigits(parts[0]) && isDigits(parts[1]) {
+		return record
+	}
+
+	var digits strings.Builder
+	for _, c := range strings.TrimPrefix(trimmed, "+") {
+		switch {
+		case c >= '0' && c <= '9':
+			digits.WriteRune(c)
+		case c == ' ' || c == '-' || c == '.' || c == '(' || c == ')':
+			// Formatting characters are ignored.
+		default:
+			return record
+		}
+	}
+
+	number := digits.String()
+	if !international {
+		if strings.HasPrefix(number, "00") {
+			number = number[2:]
+		} else {
+			national := strings.TrimPrefix(number, "0")
+			if len(national) != 10 {
+				return record
+			}
+			number = countryCode + national
+		}
+	}
+
+	// E.164 numbers are at most 15 digits, anything much shorter isn't a full number.
+	if len(number) < 8 || len(number) > 15 {
+		return record
+	}
+
+	return "+" + number
+}
+
+// isDigits reports whether s is a non-empty run of ASCII digits.
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// LengthBucket pairs a filter with the maximum record length it applies to.
+type LengthBucket struct {
+	MaxLen int
+	Filter Filter
+}
+
+// LengthBucketedFilter returns a filter that applies the filter of the first bucket the record's length fits within.
+// Records longer than every bucket's MaxLen are removed.
+func LengthBucketedFilter(buckets []LengthBucket) Filter {
+	return func(record string) bool {
+		for _, b := range buckets {
+			if len(record) <= b.MaxLen {
+				return b.Filter(record)
+			}
+		}
+
+		return false
+	}
+}
+
+// DuplicateGroup labels a record with the group shared by all identical records.
+type DuplicateGroup struct {
+	Record string
+	Group  int
+}
+
+// LabelDuplicateGroups labels each record with a duplicate group, without removing any records.
+// Groups are numbered from 0 in order of first appearance.
+func LabelDuplicateGroups(records []string) []DuplicateGroup {
+	groups := map[string]int{}
+	labeled := make([]DuplicateGroup, 0, len(records))
+
+	for _, record := range records {
+		g, ok := groups[record]
+		if !ok {
+			g = len(groups)
+			groups[record] = g
+		}
+		labeled = append(labeled, DuplicateGroup{Record: record, Group: g})
+	}
+
+	return labeled
+}
+
+// RetryBuild calls build until it returns a filter, up to attempts times, waiting backoff between attempts.
+// If every attempt fails, the last error is returned.
+func RetryBuild(build func() (Filter, error), attempts int, backoff time.Duration) (Filter, error) {
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+		}
+
+		var f Filter
+		if f, err = build(); err == nil {
+			return f, nil
+		}
+	}
+
+	if err == nil {
+		err = errors.New("no attempts made to build filter")
+	}
+
+	return nil, err
+}
+
+// FilterFixedWidth is a bulk filter that keeps only records whose length matches a fixed-width layout.
+func FilterFixedWidth(widths []int) FilterBulk {
+	total := 0
+	for _, w := range widths {
+		total += w
+	}
+
+	return func(records []string) []string {
+		filteredRecords := []string{}
+		for _, record := range records {
+			if len(record) == total {
+				filteredRecords = append(filteredRecords, record)
+			}
+		}
+
+		return filteredRecords
+	}
+}
+
+// ParseFixedWidth splits a fixed-width record into its fields.
+// It returns false if the record's length doesn't match the layout.
+func ParseFixedWidth(record string, widths []int) ([]string, bool) {
+	fields := make([]string, 0, len(widths))
+	for _, w := range widths {
+		if w < 0 || w > len(record) {
+			return nil, false
+		}
+		fields = append(fields, record[:w])
+		record = record[w:]
+	}
+
+	if record != "" {
+		return nil, false
+	}
+
+	return fields, true
+}
+
+// WithCircuitBreaker returns a filter set that calls onTrip when fs rejects more than maxRejectRatio of the records.
+// The result of fs is returned either way.
+func WithCircuitBreaker(fs FilterSet, maxRejectRatio float64, onTrip func(ratio float64)) FilterSet {
+	return func(records []string) []string {
+		filteredRecords := fs(records)
+		if len(records) == 0 {
+			return filteredRecords
+		}
+
+		ratio := float64(len(records)-len(filteredRecords)) / float64(len(records))
+		if ratio > maxRejectRatio {
+			onTrip(ratio)
+		}
+
+		return filteredRecords
+	}
+}
+
+// RequireOrder returns a bulk stage that errors if any adjacent pair of records is out of order according to less.
+// Equal records are allowed, so a pair only violates the order when less(b, a) is true.
+// Otherwise the records are returned unchanged.
+func RequireOrder(less func(a, b string) bool) func([]string) ([]string, error) {
+	return func(records []string) ([]string, error) {
+		for i := 1; i < len(records); i++ {
+			if less(records[i], records[i-1]) {
+				return nil, fmt.Errorf("records %d and %d are out of order: %q before %q", i-1, i, records[i-1], records[i])
+			}
+		}
+
+		return records, nil
+	}
+}
+
+// FilterBloomDedup is a bulk filter that removes duplicates using a Bloom filter instead of a map.
+// It is sized for expectedN distinct records at the given false positive rate. Memory use stays fixed,
+// but roughly falsePositiveRate of the unique records will be wrongly removed as duplicates,
+// and more than that if the batch has more than expectedN distinct records. Duplicates are always removed.
+func FilterBloomDedup(expectedN int, falsePositiveRate float64) FilterBulk {
+	if expectedN < 1 {
+		expectedN = 1
+	}
+	// Keep the rate in a range that produces a sensibly sized filter.
+	falsePositiveRate = math.Max(1e-9, math.Min(0.5, falsePositiveRate))
+
+	// Standard Bloom filter sizing: m = -n*ln(p)/ln(2)^2 bits and k = (m/n)*ln(2) hash functions.
+	bits := uint64(math.Ceil(-float64(expectedN) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	if bits < 64 {
+		bits = 64
+	}
+	hashes := int(math.Max(1, math.Round(float64(bits)/float64(expectedN)*math.Ln2)))
+
+	return func(records []string) []string {
+		bloom := newBloomFilter(bits, hashes)
+		filteredRecords := []string{}
+
+		for _, record := range records {
+			if bloom.testAndAdd(record) {
+				continue
+			}
+			filteredRecords = append(filteredRecords, record)
+		}
+
+		return filteredRecords
+	}
+}
+
+// bloomFilter is a fixed-size Bloom filter over strings.
+type bloomFilter struct {
+	bits   []uint64
+	size   uint64
+	hashes int
+}
+
+// newBloomFilter returns an empty Bloom filter with the given number of bits and hash functions.
+func newBloomFilter(size uint64, hashes int) *bloomFilter {
+	return &bloomFilter{
+		bits:   make([]uint64, (size+63)/64),
+		size:   size,
+		hashes: hashes,
+	}
+}
+
+// testAndAdd adds record to the filter and reports whether it was probably already present.
+func (b *bloomFilter) testAndAdd(record string) bool {
+	// Derive every hash from two base hashes (Kirsch-Mitzenmacher double hashing).
+	h := fnv.New64a()
+	h.Write([]byte(record))
+	h1 := h.Sum64()
+	h2 := h1>>33 | h1<<31 | 1
+
+	present := true
+	for i := 0; i < b.hashes; i++ {
+		idx := (h1 + uint64(i)*h2) % b.size
+		word, mask := idx/64, uint64(1)<<(idx%64)
+		if b.bits[word]&mask == 0 {
+			present = false
+			b.bits[word] |= mask
+		}
+	}
+
+	return present
+}
+
+// RequireContains returns a bulk stage that errors if any of the required records is missing.
+// Otherwise the records are returned unchanged.
+func RequireContains(required ...string) func([]string) ([]string, error) {
+	return func(records []string) ([]string, error) {
+		present := toSet(records)
+
+		missing := []string{}
+		for _, r := range required {
+			if !present[r] {
+				missing = append(missing, r)
+			}
+		}
+
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("missing required records: %q", missing)
+		}
+
+		return records, nil
+	}
+}
+
+// ApplyFiltersTimed applies a set of named filters to a record list like ApplyFilters,
+// but gives each filter at most perFilterTimeout to process the whole batch.
+// A filter that times out is treated as keeping every record, and its name is returned in timedOut.
+// Filters can't be interrupted, so a timed out filter keeps running in the background until it finishes.
+func ApplyFiltersTimed(records []string, perFilterTimeout time.Duration, filters ...NamedFilter) (kept []string, timedOut []string) {
+	kept = records
+	timedOut = []string{}
+
+	for _, f := range filters {
+		ctx, cancel := context.WithTimeout(context.Background(), perFilterTimeout)
+
+		// Buffered so the goroutine can always finish, even after its result is abandoned.
+		result := make(chan []string, 1)
+		go func(f Filter, batch []string) {
+			result <- ApplyFilters(batch, f)
+		}(f.Filter, kept)
+
+		select {
+		case kept = <-result:
+		case <-ctx.Done():
+			timedOut = append(timedOut, f.Name)
+		}
+		cancel()
+	}
+
+	return kept, timedOut
+}
+
+// TransposeRecords returns a function that splits each record on sep and returns the fields as columns.
+// Rows with fewer fields than the widest row are padded with empty strings.
+func TransposeRecords(sep string) func([]string) [][]string {
+	return func(records []string) [][]string {
+		rows := make([][]string, 0, len(records))
+		width := 0
+		for _, record := range records {
+			fields := strings.Split(record, sep)
+			if len(fields) > width {
+				width = len(fields)
+			}
+			rows = append(rows, fields)
+		}
+
+		columns := make([][]string, width)
+		for c := range columns {
+			columns[c] = make([]string, len(rows))
+			for r, fields := range rows {
+				if c < len(fields) {
+					columns[c][r] = fields[c]
+				}
+			}
+		}
+
+		return columns
+	}
+}
+
+// Validate runs a set of batch-level validation rules on the records before filtering.
+// Every rule is run, and all their errors are joined into one.
+func Validate(records []string, rules ...func([]string) error) error {
+	errs := []error{}
+	for _, rule := range rules {
+		if err := rule(records); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// NonNil is a validation rule that rejects a nil slice of records.
+func NonNil() func([]string) error {
+	return func(records []string) error {
+		if records == nil {
+			return errors.New("records are nil")
+		}
+
+		return nil
+	}
+}
+
+// MaxBatchSize is a validation rule that rejects batches with more than n records.
+func MaxBatchSize(n int) func([]string) error {
+	return func(records []string) error {
+		if len(records) > n {
+			return fmt.Errorf("batch has %d records, maximum is %d", len(records), n)
+		}
+
+		return nil
+	}
+}
+
+// RequireMaxCardinality returns a bulk stage that errors if there are more than max distinct records.
+// Otherwise the records are returned unchanged.
+func RequireMaxCardinality(max int) func([]string) ([]string, error) {
+	return func(records []string) ([]string, error) {
+		if distinct := len(toSet(records)); distinct > max {
+			return nil, fmt.Errorf("expected at most %d distinct records, got %d", max, distinct)
+		}
+
+		return records, nil
+	}
+}
+
+// TaggedRecord is a record labeled with the source it came from.
+type TaggedRecord struct {
+	Tag   string
+	Value string
+}
+
+// ApplyTaggedFilters applies the filter registered for each record's tag to its value.
+// Records whose tag has no filter are kept.
+func ApplyTaggedFilters(records []TaggedRecord, byTag map[string]Filter) []TaggedRecord {
+	filteredRecords := make([]TaggedRecord, 0, len(records))
+
+	for _, r := range records {
+		if f, ok := byTag[r.Tag]; ok && !f(r.Value) {
+			continue
+		}
+		filteredRecords = append(filteredRecords, r)
+	}
+
+	return filteredRecords
+}
+
+// FilterRareNGrams is a bulk filter that removes records containing character n-grams rare in the batch.
+// An n-gram's frequency is the number of records it appears in, and a record is removed
+// if any of its n-grams has a frequency below minFreq. Records shorter than n are kept.
+func FilterRareNGrams(n int, minFreq int) FilterBulk {
+	return func(records []string) []string {
+		if n <= 0 {
+			return records
+		}
+
+		grams := make([]map[string]bool, len(records))
+		freqs := map[string]int{}
+		for i, record := range records {
+			grams[i] = nGrams(record, n)
+			for g := range grams[i] {
+				freqs[g]++
+			}
+		}
+
+		filteredRecords := []string{}
+		for i, record := range records {
+			keep := true
+			for g := range grams[i] {
+				if freqs[g] < minFreq {
+					keep = false
+					break
+				}
+			}
+
+			if keep {
+				filteredRecords = append(filteredRecords, record)
+			}
+		}
+
+		return filteredRecords
+	}
+}
+
+// nGrams returns the set of distinct n-rune substrings of record.
+func nGrams(record string, n int) map[string]bool {
+	runes := []rune(record)
+	grams := map[string]bool{}
+	for i := 0; i+n <= len(runes); i++ {
+		grams[string(runes[i:i+n])] = true
+	}
+
+	return grams
+}
+
+// PipelineStage is a single step of a pipeline run by RunWithSnapshots.
+type PipelineStage func([]string) []string
+
+// FilterStage returns a pipeline stage that applies a set of filters with ApplyFilters.
+func FilterStage(filters ...Filter) PipelineStage {
+	return func(records []string) []string {
+		return ApplyFilters(records, filters...)
+	}
+}
+
+// BulkStage returns a pipeline stage that applies a set of bulk filters with ApplyBulkFilters.
+func BulkStage(filters ...FilterBulk) PipelineStage {
+	return func(records []string) []string {
+		return ApplyBulkFilters(records, filters...)
+	}
+}
+
+// RunWithSnapshots runs the records through each stage in order, and returns the final records
+// along with a snapshot of the records after every stage.
+func RunWithSnapshots(records []string, stages ...PipelineStage) ([]string, [][]string) {
+	snapshots := make([][]string, 0, len(stages))
+	for _, stage := range stages {
+		records = stage(records)
+		snapshots = append(snapshots, records)
+	}
+
+	return records, snapshots
+}
+
+// FilterChecksumSuffix is a bulk filter that keeps only records whose checksum suffix matches their content.
+// Each record is split on its last sep, and kept if algo of the prefix equals the suffix.
+// Records without sep are removed.
+func FilterChecksumSuffix(sep string, algo func(string) string) FilterBulk {
+	return func(records []string) []string {
+		filteredRecords := []string{}
+		for _, record := range records {
+			i := strings.LastIndex(record, sep)
+			if i < 0 {
+				continue
+			}
+			if algo(record[:i]) == record[i+len(sep):] {
+				filteredRecords = append(filteredRecords, record)
+			}
+		}
+
+		return filteredRecords
+	}
+}
+
+// FilterSeq applies a set of filters to a record list like ApplyFilters, but lazily.
+// Records are filtered one at a time as the sequence is ranged over, and stopping early skips the rest.
+func FilterSeq(records []string, filters ...Filter) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for _, r := range records {
+			if !passesFilters(r, filters...) {
+				continue
+			}
+			if !yield(r) {
+				return
+			}
+		}
+	}
+}
+
+// JaccardSimilarity returns the size of the intersection over the size of the union of the distinct records in a and b.
+// Two empty batches are considered identical.
+func JaccardSimilarity(a, b []string) float64 {
+	setA := toSet(a)
+	setB := toSet(b)
+	if len(setA) == 0 && len(setB) == 0 {
+		return 1
+	}
+
+	intersection := 0
+	for r := range setA {
+		if setB[r] {
+			intersection++
+		}
+	}
+	union := len(setA) + len(setB) - intersection
+
+	return float64(intersection) / float64(union)
+}
+
+// ApplySelective applies a set of filters only to the records passing selector.
+// Records failing selector are always kept.
+func ApplySelective(records []string, selector Filter, filters ...Filter) []string {
+	filteredRecords := make([]string, 0, len(records))
+
+	for _, r := range records {
+		if selector(r) && !passesFilters(r, filters...) {
+			continue
+		}
+		filteredRecords = append(filteredRecords, r)
+	}
+
+	return filteredRecords
+}
+
+// FilterDiverse is a bulk filter that removes records too similar to an earlier kept record.
+// Records are considered in order, and a record is removed if its similarity to any kept record exceeds maxSim.
+// Every record is compared to every kept record, so this is O(n²) in the worst case.
+func FilterDiverse(similarity func(a, b string) float64, maxSim float64) FilterBulk {
+	return func(records []string) []string {
+		filteredRecords := []string{}
+
+		for _, record := range records {
+			keep := true
+			for _, k := range filteredRecords {
+				if similarity(record, k) > maxSim {
+					keep = false
+					break
+				}
+			}
+
+			if keep {
+				filteredRecords = append(filteredRecords, record)
+			}
+		}
+
+		return filteredRecords
+	}
+}
+
+// ApplyParseFilters applies a set of parse filters to a record list.
+// Each filter either removes the record or rewrites it before it is passed to the next filter.
+func ApplyParseFilters(records []string, filters ...ParseFilter) []string {
+	filteredRecords := make([]string, 0, len(records))
+
+	for _, r := range records {
+		keep := true
+
+		for _, f := range filters {
+			if r, keep = f(r); !keep {
+				break
+			}
+		}
+
+		if keep {
+			filteredRecords = append(filteredRecords, r)
+		}
+	}
+
+	return filteredRecords
+}
+
+// FilterMinEntropy removes any records whose character distribution has less Shannon entropy than bitsPerChar.
+// Empty records have no entropy and are removed unless bitsPerChar is 0 or less.
+func FilterMinEntropy(bitsPerChar float64) Filter {
+	return func(record string) bool {
+		counts := map[rune]int{}
+		total := 0
+		for _, r := range record {
+			counts[r]++
+			total++
+		}
+
+		entropy := 0.0
+		for _, c := range counts {
+			p := float64(c) / float64(total)
+			entropy -= p * math.Log2(p)
+		}
+
+		return entropy >= bitsPerChar
+	}
+}
+
+// FilterQuorum returns a filter that keeps records passing at least k of the given filters.
+// A k of len(filters) requires every filter to pass, and a k of 1 requires any one of them.
+func FilterQuorum(k int, filters ...Filter) Filter {
+	return func(record string) bool {
+		passed := 0
+		for i, f := range filters {
+			if f(record) {
+				passed++
+			}
+			if passed >= k {
+				return true
+			}
+			// Stop early once the remaining filters can't reach the quorum.
+			if passed+len(filters)-i-1 < k {
+				return false
+			}
+		}
+
+		return passed >= k
+	}
+}
+
+// SplitTrainTest splits the records into train and test sets by hashing each record with the seed.
+// Roughly testFraction of the records go to test, and a record always lands in the same set for the same seed.
+func SplitTrainTest(records []string, testFraction float64, seed int64) (train, test []string) {
+	const buckets = 1000000
+	threshold := uint64(math.Max(0, math.Min(1, testFraction)) * buckets)
+
+	seedBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(seedBytes, uint64(seed))
+
+	train = []string{}
+	test = []string{}
+	for _, record := range records {
+		h := fnv.New64a()
+		h.Write(seedBytes)
+		h.Write([]byte(record))
+
+		if h.Sum64()%buckets < threshold {
+			test = append(test, record)
+		} else {
+			train = append(train, record)
+		}
+	}
+
+	return train, test
+}
+
+// QuotaFilter enforces a limit on the total number of records processed across batches.
+type QuotaFilter struct {
+	remaining int
+}
+
+// NewQuotaFilter returns a quota filter that allows quota records in total.
+func NewQuotaFilter(quota int) *QuotaFilter {
+	return &QuotaFilter{remaining: quota}
+}
+
+// Filter keeps records until the quota is used up, and removes every record after that.
+func (q *QuotaFilter) Filter(records []string) []string {
+	if q.remaining <= 0 {
+		return []string{}
+	}
+
+	if len(records) > q.remaining {
+		records = records[:q.remaining]
+	}
+	q.remaining -= len(records)
+
+	return records
+}
+
+// Remaining returns how many more records can be processed before the quota is used up.
+func (q *QuotaFilter) Remaining() int {
+	return q.remaining
+}
+
+// FilterSubstrings is a bulk filter that removes any record contained within a longer record in the batch.
+// Identical records don't count as substrings of each other, so they are kept.
+// Every record is compared to every other, so this is O(n²).
+func FilterSubstrings() FilterBulk {
+	return func(records []string) []string {
+		filteredRecords := []string{}
+
+		for _, record := range records {
+			contained := false
+			for _, other := range records {
+				if len(other) > len(record) && strings.Contains(other, record) {
+					contained = true
+					break
+				}
+			}
+
+			if !contained {
+				filteredRecords = append(filteredRecords, record)
+			}
+		}
+
+		return filteredRecords
+	}
+}
+
+// Chain wraps a filter in a set of middleware.
+// The first middleware passed in is the outermost, so it sees each record first.
+func Chain(f Filter, mw ...Middleware) Filter {
+	for i := len(mw) - 1; i >= 0; i-- {
+		f = mw[i](f)
+	}
+
+	return f
+}
+
+// FilterJSONSchema returns a bulk filter that keeps only records that are JSON documents valid against schema.
+// The schema is compiled once, using draft 2020-12 unless it declares another with "$schema",
+// and an error is returned if it is invalid. Only the schema itself is loaded, so "$ref" must point within it.
+func FilterJSONSchema(schema string) (FilterBulk, error) {
+	doc, err := jsonschema.UnmarshalJSON(strings.NewReader(schema))
+	if err != nil {
+		return nil, fmt.Errorf("parsing schema: %w", err)
+	}
+
+	c := jsonschema.NewCompiler()
+	c.DefaultDraft(jsonschema.Draft2020)
+	if err := c.AddResource("schema.json", doc); err != nil {
+		return nil, err
+	}
+	compiled, err := c.Compile("schema.json")
+	if err != nil {
+		return nil, err
+	}
+
+	return func(records []string) []string {
+		filteredRecords := []string{}
+		for _, record := range records {
+			// UnmarshalJSON keeps numbers as json.Number, so large integers validate exactly.
+			doc, err := jsonschema.UnmarshalJSON(strings.NewReader(record))
+			if err != nil {
+				continue
+			}
+			if compiled.Validate(doc) == nil {
+				filteredRecords = append(filteredRecords, record)
+			}
+		}
+
+		return filteredRecords
+	}, nil
+}
+
+// Page returns the records on the given 1-based page, and whether there are more pages after it.
+// Pages out of range return no records.
+func Page(records []string, pageSize, pageNum int) ([]string, bool) {
+	if pageSize <= 0 || pageNum <= 0 {
+		return []string{}, false
+	}
+
+	start := (pageNum - 1) * pageSize
+	if start >= len(records) {
+		return []string{}, false
+	}
+
+	end := start + pageSize
+	if end >= len(records) {
+		return records[start:], false
+	}
+
+	return records[start:end], true
+}
+
+// RecordScore is the fraction of filters a record passed.
+type RecordScore struct {
+	Record string
+	Score  float64
+}
+
+// ScoreRecords scores each record by the fraction of the named filters it passes, without removing any records.
+// With no filters every record scores 1.
+func ScoreRecords(records []string, filters ...NamedFilter) []RecordScore {
+	scores := make([]RecordScore, 0, len(records))
+
+	for _, r := range records {
+		score := 1.0
+		if len(filters) > 0 {
+			passed := 0
+			for _, f := range filters {
+				if f.Filter(r) {
+					passed++
+				}
+			}
+			score = float64(passed) / float64(len(filters))
+		}
+		scores = append(scores, RecordScore{Record: r, Score: score})
+	}
+
+	return scores
+}
+
+// IncrementalFilter filters records as they are appended, without re-filtering earlier records.
+// Records are removed if they fail any of the filters or were kept by an earlier Append.
+type IncrementalFilter struct {
+	filters []Filter
+	deduper *StatefulDeduper
+}
+
+// NewIncrementalFilter returns an incremental filter that applies the given filters to each appended record.
+func NewIncrementalFilter(filters ...Filter) *IncrementalFilter {
+	return &IncrementalFilter{
+		filters: filters,
+		deduper: NewStatefulDeduper(0),
+	}
+}
+
+// Append filters the new records and returns the ones that survive.
+func (f *IncrementalFilter) Append(records []string) []string {
+	return f.deduper.Filter(ApplyFilters(records, f.filters...))
+}
+
+// TruncateToBytes is a bulk filter that shortens any record longer than maxPerRecord bytes, without removing any records.
+// Records are cut at a character boundary, so a multibyte character is never split.
+func TruncateToBytes(maxPerRecord int) FilterBulk {
+	return func(records []string) []string {
+		filteredRecords := make([]string, 0, len(records))
+		for _, record := range records {
+			if len(record) > maxPerRecord {
+				cut := maxPerRecord
+				if cut < 0 {
+					cut = 0
+				}
+				for cut > 0 && !utf8.RuneStart(record[cut]) {
+					cut--
+				}
+				record = record[:cut]
+			}
+			filteredRecords = append(filteredRecords, record)
+		}
+
+		return filteredRecords
+	}
+}
+
+// TieBreaker decides the order of records that rank equally.
+type TieBreaker int
+
+const (
+	// ByIndex orders tied records by their position in the input.
+	ByIndex TieBreaker = iota
+	// ByLexical orders tied records alphabetically.
+	ByLexical
+	// ByHash orders tied records by their FNV-1a hash, a stable but arbitrary order.
+	ByHash
+)
+
+// less reports whether record a at index ai should come before record b at index bi.
+// Records that are still tied fall back to input order.
+func (tb TieBreaker) less(a string, ai int, b string, bi int) bool {
+	switch tb {
+	case ByLexical:
+		if a != b {
+			return a < b
+		}
+	case ByHash:
+		if ha, hb := hashRecord(a), hashRecord(b); ha != hb {
+			return ha < hb
+		}
+	}
+
+	return ai < bi
+}
+
+// hashRecord returns the FNV-1a hash of a record.
+func hashRecord(record string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(record))
+	return h.Sum64()
+}
+
+// rankRecords returns the indexes of records ordered by descending score, with ties broken by tb.
+func rankRecords(records []string, score func(i int) int, tb TieBreaker) []int {
+	order := make([]int, len(records))
+	for i := range order {
+		order[i] = i
+	}
+
+	sort.Slice(order, func(x, y int) bool {
+		i, j := order[x], order[y]
+		if si, sj := score(i), score(j); si != sj {
+			return si > sj
+		}
+		return tb.less(records[i], i, records[j], j)
+	})
+
+	return order
+}
+
+// FilterLongest is a bulk filter that keeps the n longest records, longest first, with ties broken by tb.
+func FilterLongest(n int, tb TieBreaker) FilterBulk {
+	return func(records []string) []string {
+		order := rankRecords(records, func(i int) int { return len(records[i]) }, tb)
+
+		filteredRecords := []string{}
+		for _, i := range order {
+			if len(filteredRecords) >= n {
+				break
+			}
+			filteredRecords = append(filteredRecords, records[i])
+		}
+
+		return filteredRecords
+	}
+}
+
+// FilterMostFrequent is a bulk filter that keeps the n most frequent distinct records, most frequent first,
+// with ties broken by tb.
+func FilterMostFrequent(n int, tb TieBreaker) FilterBulk {
+	return func(records []string) []string {
+		unique, counts := FilterDuplicatesWithCounts(records)
+		order := rankRecords(unique, func(i int) int { return counts[i] }, tb)
+
+		filteredRecords := []string{}
+		for _, i := range order {
+			if len(filteredRecords) >= n {
+				break
+			}
+			filteredRecords = append(filteredRecords, unique[i])
+		}
+
+		return filteredRecords
+	}
+}
+
+// FilterDenyPatternsFile returns a bulk filter that removes any records matching a pattern listed in the file at path.
+// The file holds one regular expression per line, and blank lines are ignored.
+// An error is returned if the file can't be read or any pattern fails to compile.
+func FilterDenyPatternsFile(path string) (FilterBulk, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	patterns := []*regexp.Regexp{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		re, err := regexp.Compile(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		patterns = append(patterns, re)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return func(records []string) []string {
+		filteredRecords := []string{}
+		for _, record := range records {
+			denied := false
+			for _, re := range patterns {
+				if re.MatchString(record) {
+					denied = true
+					break
+				}
+			}
+
+			if !denied {
+				filteredRecords = append(filteredRecords, record)
+			}
+		}
+
+		return filteredRecords
+	}, nil
+}
+
+// Metrics counts records passing through filter sets, and is safe to share between goroutines.
+type Metrics struct {
+	RecordsIn  atomic.Int64
+	RecordsOut atomic.Int64
+
+	mu       sync.Mutex
+	rejected map[string]int64
+}
+
+// WithMetrics returns a filter set that applies fs and adds the records in and out of each run to m.
+// Rejections are attributed to individual filters by wrapping them with CountRejections.
+func WithMetrics(fs FilterSet, m *Metrics) FilterSet {
+	return func(records []string) []string {
+		m.RecordsIn.Add(int64(len(records)))
+		filteredRecords := fs(records)
+		m.RecordsOut.Add(int64(len(filteredRecords)))
+
+		return filteredRecords
+	}
+}
+
+// CountRejections returns middleware that counts the records rejected by a filter under the given name.
+// Filter sets are opaque, so this is how rejections are attributed to individual filters, e.g. using Chain.
+func (m *Metrics) CountRejections(name string) Middleware {
+	return func(f Filter) Filter {
+		return func(record string) bool {
+			if f(record) {
+				return true
+			}
+
+			m.mu.Lock()
+			if m.rejected == nil {
+				m.rejected = map[string]int64{}
+			}
+			m.rejected[name]++
+			m.mu.Unlock()
+
+			return false
+		}
+	}
+}
+
+// Rejected returns the number of records rejected by the named filter so far.
+func (m *Metrics) Rejected(name string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.rejected[name]
+}
+
+// RejectedByFilter returns a snapshot of the rejections counted so far, keyed by filter name.
+// The map is a copy, so it is safe to read while filters are running.
+func (m *Metrics) RejectedByFilter() map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := make(map[string]int64, len(m.rejected))
+	for name, n := range m.rejected {
+		snapshot[name] = n
+	}
+
+	return snapshot
+}
+
+// FilterMergeVersioned is a bulk filter that keeps only the highest versioned record for each base name.
+// pattern must match the version suffix, e.g. ` \((\d+)\)$`, with its first group holding the version number.
+// The base name is the record with the suffix removed, and records without a suffix are version 1.
+// Each kept record takes the position where its base name first appeared.
+func FilterMergeVersioned(pattern *regexp.Regexp) FilterBulk {
+	return func(records []string) []string {
+		index := map[string]int{}
+		versions := []int{}
+		filteredRecords := []string{}
+
+		for _, record := range records {
+			base, version := record, 1
+			if loc := pattern.FindStringSubmatchIndex(record); len(loc) >= 4 && loc[2] >= 0 {
+				v, err := strconv.Atoi(record[loc[2]:loc[3]])
+				if err == nil {
+					base, version = record[:loc[0]]+record[loc[1]:], v
+				}
+			}
+
+			i, ok := index[base]
+			if !ok {
+				index[base] = len(filteredRecords)
+				filteredRecords = append(filteredRecords, record)
+				versions = append(versions, version)
+				continue
+			}
+			if version > versions[i] {
+				filteredRecords[i] = record
+				versions[i] = version
+			}
+		}
+
+		return filteredRecords
+	}
+}
+
+// TeeFilter applies a set of filters to a record list like ApplyFilters, and also writes each kept record,
+// newline-terminated, to every writer. The first write error stops filtering and is returned.
+func TeeFilter(records []string, filters []Filter, writers ...io.Writer) ([]string, error) {
+	w := io.MultiWriter(writers...)
+	filteredRecords := make([]string, 0, len(records))
+
+	for _, r := range records {
+		if !passesFilters(r, filters...) {
+			continue
+		}
+
+		if _, err := io.WriteString(w, r+"\n"); err != nil {
+			return nil, err
+		}
+		filteredRecords = append(filteredRecords, r)
+	}
+
+	return filteredRecords, nil
+}
+
+// FilterTimeWindow is a bulk filter that keeps only records whose timestamp is within [start, end).
+// Timestamps are taken from each record with extract, and records without one are removed.
+func FilterTimeWindow(extract func(string) (time.Time, bool), start, end time.Time) FilterBulk {
+	return func(records []string) []string {
+		filteredRecords := []string{}
+		for _, record := range records {
+			t, ok := extract(record)
+			if !ok || t.Before(start) || !t.Before(end) {
+				continue
+			}
+			filteredRecords = append(filteredRecords, record)
+		}
+
+		return filteredRecords
+	}
+}
+
+// ApplyNamedFilters applies a set of named filters to a record list like ApplyFilters.
+func ApplyNamedFilters(records []string, filters ...NamedFilter) []string {
+	plain := make([]Filter, 0, len(filters))
+	for _, f := range filters {
+		plain = append(plain, f.Filter)
+	}
+
+	return ApplyFilters(records, plain...)
+}
+
+// OptimizeOrder returns the filters reordered so that cheap filters which reject many records run first.
+// Each filter's cost and rejection rate are measured on a sample of up to 100 records spread across the batch,
+// and filters are ordered by cost per rejection. Filters that reject nothing in the sample go last, cheapest first.
+func OptimizeOrder(records []string, filters []NamedFilter) []NamedFilter {
+	const sampleSize = 100
+
+	sample := records
+	if len(records) > sampleSize {
+		sample = make([]string, 0, sampleSize)
+		for i := 0; i < sampleSize; i++ {
+			sample = append(sample, records[i*len(records)/sampleSize])
+		}
+	}
+
+	type estimate struct {
+		filter   NamedFilter
+		cost     time.Duration
+		rejected int
+	}
+	estimates := make([]estimate, 0, len(filters))
+	for _, f := range filters {
+		e := estimate{filter: f}
+		start := time.Now()
+		for _, r := range sample {
+			if !f.Filter(r) {
+				e.rejected++
+			}
+		}
+		e.cost = time.Since(start)
+		estimates = append(estimates, e)
+	}
+
+	sort.SliceStable(estimates, func(i, j int) bool {
+		a, b := estimates[i], estimates[j]
+		if a.rejected == 0 || b.rejected == 0 {
+			if a.rejected != b.rejected {
+				return b.rejected == 0
+			}
+			return a.cost < b.cost
+		}
+		return float64(a.cost)/float64(a.rejected) < float64(b.cost)/float64(b.rejected)
+	})
+
+	ordered := make([]NamedFilter, 0, len(estimates))
+	for _, e := range estimates {
+		ordered = append(ordered, e.filter)
+	}
+
+	return ordered
+}
+
+// TopKPerGroup is a bulk filter that keeps the k longest records in each group, as given by key.
+// Groups are output in the order they first appear, each with its records longest first,
+// and records of equal length keep their input order.
+func TopKPerGroup(key func(string) string, k int) FilterBulk {
+	return func(records []string) []string {
+		order := []string{}
+		groups := map[string][]string{}
+		for _, record := range records {
+			g := key(record)
+			if _, ok := groups[g]; !ok {
+				order = append(order, g)
+			}
+			groups[g] = append(groups[g], record)
+		}
+
+		filteredRecords := []string{}
+		for _, g := range order {
+			members := groups[g]
+			ranked := rankRecords(members, func(i int) int { return len(members[i]) }, ByIndex)
+			for n, i := range ranked {
+				if n >= k {
+					break
+				}
+				filteredRecords = append(filteredRecords, members[i])
+			}
+		}
+
+		return filteredRecords
+	}
+}
+
+// FilterSetConfig describes a filter set as its named filters and bulk filters, so it can be checked before use.
+type FilterSetConfig struct {
+	Filters []NamedFilter
+	Bulk    []FilterBulk
+	// Canary is the record each filter is run against by Validate.
+	Canary string
+}
+
+// FilterSet returns the filter set described by the config.
+func (c FilterSetConfig) FilterSet() FilterSet {
+	return func(records []string) []string {
+		return ApplyBulkFilters(ApplyNamedFilters(records, c.Filters...), c.Bulk...)
+	}
+}
+
+// Validate runs every filter once against the canary record, and returns an error for each nil or panicking filter.
+func (c FilterSetConfig) Validate() error {
+	errs := []error{}
+
+	for _, f := range c.Filters {
+		if f.Filter == nil {
+			errs = append(errs, fmt.Errorf("filter %q is nil", f.Name))
+			continue
+		}
+		if err := callSafely(func() { f.Filter(c.Canary) }); err != nil {
+			errs = append(errs, fmt.Errorf("filter %q: %w", f.Name, err))
+		}
+	}
+	for i, f := range c.Bulk {
+		if f == nil {
+			errs = append(errs, fmt.Errorf("bulk filter %d is nil", i))
+			continue
+		}
+		if err := callSafely(func() { f([]string{c.Canary}) }); err != nil {
+			errs = append(errs, fmt.Errorf("bulk filter %d: %w", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// callSafely calls fn and returns any panic it raises as an error.
+func callSafely(fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	fn()
+	return nil
+}
+
+// FilterHammingDedup is a bulk filter that removes records within maxDistance differing characters of an earlier kept record.
+// Only records of the same length are compared, so records of different lengths are never merged.
+func FilterHammingDedup(maxDistance int) FilterBulk {
+	return func(records []string) []string {
+		kept := map[int][][]rune{}
+		filteredRecords := []string{}
+
+		for _, record := range records {
+			runes := []rune(record)
+
+			duplicate := false
+			for _, other := range kept[len(runes)] {
+				if hammingDistance(runes, other) <= maxDistance {
+					duplicate = true
+					break
+				}
+			}
+
+			if !duplicate {
+				kept[len(runes)] = append(kept[len(runes)], runes)
+				filteredRecords = append(filteredRecords, record)
+			}
+		}
+
+		return filteredRecords
+	}
+}
+
+// hammingDistance returns the number of positions at which two equal-length rune slices differ.
+func hammingDistance(a, b []rune) int {
+	d := 0
+	for i := range a {
+		if a[i] != b[i] {
+			d++
+		}
+	}
+
+	return d
+}
+
+// AdaptiveFilter is a bulk filter that applies strict, and if strict rejects more than rejectThreshold
+// of the records, applies relaxed to the original records instead. Only one result is ever returned:
+// the strict result when it is within the threshold, otherwise the relaxed result.
+func AdaptiveFilter(strict, relaxed Filter, rejectThreshold float64) FilterBulk {
+	return func(records []string) []string {
+		filteredRecords := ApplyFilters(records, strict)
+		if len(records) == 0 {
+			return filteredRecords
+		}
+
+		ratio := float64(len(records)-len(filteredRecords)) / float64(len(records))
+		if ratio > rejectThreshold {
+			return ApplyFilters(records, relaxed)
+		}
+
+		return filteredRecords
+	}
+}
+
+// FilterDedupPaths is a bulk filter that removes paths equivalent to an earlier path once cleaned with path.Clean.
+// The first path is kept as it was written.
+func FilterDedupPaths() FilterBulk {
+	return func(records []string) []string {
+		seen := map[string]bool{}
+		filteredRecords := []string{}
+
+		for _, record := range records {
+			cleaned := path.Clean(record)
+			if seen[cleaned] {
+				continue
+			}
+			seen[cleaned] = true
+			filteredRecords = append(filteredRecords, record)
+		}
+
+		return filteredRecords
+	}
+}
+
+// Recording is the input and output of a filter set run, kept for replaying later.
+type Recording struct {
+	Input  []string `json:"input"`
+	Output []string `json:"output"`
+}
+
+// Capture applies the filter set to the records and records the input and output.
+func Capture(fs FilterSet, records []string) Recording {
+	input := append([]string{}, records...)
+
+	return Recording{
+		Input:  input,
+		Output: append([]string{}, fs(input)...),
+	}
+}
+
+// AssertReplay applies the filter set to the recorded input, and errors if the output differs from the recording.
+func AssertReplay(r Recording, fs FilterSet) error {
+	output := fs(r.Input)
+	if len(output) != len(r.Output) {
+		return fmt.Errorf("replay produced %d records, recording has %d", len(output), len(r.Output))
+	}
+
+	for i := range output {
+		if output[i] != r.Output[i] {
+			return fmt.Errorf("replay record %d is %q, recording has %q", i, output[i], r.Output[i])
+		}
+	}
+
+	return nil
+}
+
+// RequireMinPrefixes returns a bulk stage that errors if the records have fewer than min distinct prefixes
+// of prefixLen bytes. Records shorter than prefixLen are their own prefix. Otherwise the records are returned unchanged.
+func RequireMinPrefixes(prefixLen, min int) func([]string) ([]string, error) {
+	return func(records []string) ([]string, error) {
+		prefixes := map[string]bool{}
+		for _, record := range records {
+			if len(record) > prefixLen {
+				record = record[:prefixLen]
+			}
+			prefixes[record] = true
+		}
+
+		if len(prefixes) < min {
+			return nil, fmt.Errorf("expected at least %d distinct prefixes, got %d", min, len(prefixes))
+		}
+
+		return records, nil
+	}
+}
+
+// FilterTopWeighted is a bulk filter that keeps the n records with the highest weight, with ties going to the earlier record.
+// Kept records stay in their original order.
+func FilterTopWeighted(weight func(string) float64, n int) FilterBulk {
+	return func(records []string) []string {
+		weights := make([]float64, len(records))
+		order := make([]int, len(records))
+		for i, record := range records {
+			weights[i] = weight(record)
+			order[i] = i
+		}
+
+		sort.SliceStable(order, func(x, y int) bool { return weights[order[x]] > weights[order[y]] })
+		if n < len(order) {
+			order = order[:max(n, 0)]
+		}
+		sort.Ints(order)
+
+		filteredRecords := make([]string, 0, len(order))
+		for _, i := range order {
+			filteredRecords = append(filteredRecords, records[i])
+		}
+
+		return filteredRecords
+	}
+}
+
+// FilterAnagramDedup is a bulk filter that removes records that are anagrams of an earlier record.
+// If caseInsensitive is true, letter case is ignored, so "Cat" and "act" are anagrams.
+func FilterAnagramDedup(caseInsensitive bool) FilterBulk {
+	return func(records []string) []string {
+		seen := map[string]bool{}
+		filteredRecords := []string{}
+
+		for _, record := range records {
+			key := record
+			if caseInsensitive {
+				key = strings.ToLower(key)
+			}
+			runes := []rune(key)
+			sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+			signature := string(runes)
+
+			if seen[signature] {
+				continue
+			}
+			seen[signature] = true
+			filteredRecords = append(filteredRecords, record)
+		}
+
+		return filteredRecords
+	}
+}
+
+// MemoFilter returns a filter that caches f's result for each record, so repeated records are only evaluated once.
+// The cache is never cleared and grows with every distinct record, so only share a memoized filter
+// within a single logical run, e.g. across the filter sets of one Classify call.
+func MemoFilter(f Filter) Filter {
+	// Each record gets its own Once, so concurrent callers wait for one evaluation instead of racing to run f.
+	type entry struct {
+		once sync.Once
+		keep bool
+	}
+
+	var mu sync.Mutex
+	cache := map[string]*entry{}
+
+	return func(record string) bool {
+		mu.Lock()
+		e, ok := cache[record]
+		if !ok {
+			e = &entry{}
+			cache[record] = e
+		}
+		mu.Unlock()
+
+		e.once.Do(func() { e.keep = f(record) })
+		return e.keep
+	}
+}
+
+// EnsureSortedBy returns a bulk stage that makes sure the records are sorted by key.
+// If autoSort is true, a stably sorted copy of the records is returned. Otherwise it errors
+// if the records aren't already sorted, and returns them unchanged if they are.
+func EnsureSortedBy(key func(string) string, autoSort bool) func([]string) ([]string, error) {
+	return func(records []string) ([]string, error) {
+		if autoSort {
+			sorted := append([]string{}, records...)
+			sort.SliceStable(sorted, func(i, j int) bool { return key(sorted[i]) < key(sorted[j]) })
+			return sorted, nil
+		}
+
+		for i := 1; i < len(records); i++ {
+			if key(records[i]) < key(records[i-1]) {
+				return nil, fmt.Errorf("record %d %q is not sorted after %q", i, records[i], records[i-1])
+			}
+		}
+
+		return records, nil
+	}
+}
+
+// DecisionBitmap applies a set of filters to a record list and returns the decisions as a bitmap,
+// where bit i is set if records[i] passed every filter.
+func DecisionBitmap(records []string, filters ...Filter) *big.Int {
+	bitmap := new(big.Int)
+	for i, r := range records {
+		if passesFilters(r, filters...) {
+			bitmap.SetBit(bitmap, i, 1)
+		}
+	}
+
+	return bitmap
+}
+
+// RewriteRecords is a bulk filter that replaces any record found in table with its mapped value.
+// Records not in the table are left unchanged.
+func RewriteRecords(table map[string]string) FilterBulk {
+	return func(records []string) []string {
+		filteredRecords := make([]string, 0, len(records))
+		for _, record := range records {
+			if replacement, ok := table[record]; ok {
+				record = replacement
+			}
+			filteredRecords = append(filteredRecords, record)
+		}
+
+		return filteredRecords
+	}
+}
+
+// BulkIf is a bulk filter that applies f only when pred is true for the batch.
+// Otherwise the records are returned unchanged.
+func BulkIf(pred func([]string) bool, f FilterBulk) FilterBulk {
+	return func(records []string) []string {
+		if !pred(records) {
+			return records
+		}
+
+		return f(records)
+	}
+}
+
+// FilterCSVFieldCount is a bulk filter that keeps only records that parse as a single CSV row with want fields.
+// Quoted fields may contain commas, and records that aren't valid CSV or hold more than one row are removed.
+func FilterCSVFieldCount(want int) FilterBulk {
+	return func(records []string) []string {
+		filteredRecords := []string{}
+		for _, record := range records {
+			reader := csv.NewReader(strings.NewReader(record))
+			reader.FieldsPerRecord = -1
+
+			fields, err := reader.Read()
+			if err != nil || len(fields) != want {
+				continue
+			}
+			if _, err := reader.Read(); err != io.EOF {
+				continue
+			}
+			filteredRecords = append(filteredRecords, record)
+		}
+
+		return filteredRecords
+	}
+}
+
+// FilterLengthPercentile is a bulk filter that keeps records whose length is between the lowPct and highPct
+// percentiles of the batch's record lengths, inclusive. Percentiles are linearly interpolated between lengths.
+func FilterLengthPercentile(lowPct, highPct float64) FilterBulk {
+	return func(records []string) []string {
+		if len(records) == 0 {
+			return records
+		}
+
+		lengths := make([]int, 0, len(records))
+		for _, record := range records {
+			lengths = append(lengths, len(record))
+		}
+		sort.Ints(lengths)
+
+		percentile := func(p float64) float64 {
+			rank := math.Max(0, math.Min(1, p/100)) * float64(len(lengths)-1)
+			lower := int(math.Floor(rank))
+			upper := int(math.Ceil(rank))
+			return float64(lengths[lower]) + (rank-float64(lower))*float64(lengths[upper]-lengths[lower])
+		}
+		low, high := percentile(lowPct), percentile(highPct)
+
+		filteredRecords := []string{}
+		for _, record := range records {
+			if l := float64(len(record)); l >= low && l <= high {
+				filteredRecords = append(filteredRecords, record)
+			}
+		}
+
+		return filteredRecords
+	}
+}
+
+// FilterDuplicatesLocale is a bulk filter that removes records that collate equal to an earlier record under the locale.
+// Records are compared at primary strength (collate.Loose), so differences in accents, case and width are ignored,
+// e.g. "café" and "Cafe" are duplicates. The first record is kept.
+func FilterDuplicatesLocale(tag language.Tag) FilterBulk {
+	return func(records []string) []string {
+		// Collators aren't safe for concurrent use, so each run gets its own.
+		c := collate.New(tag, collate.Loose)
+		var buf collate.Buffer
+
+		seen := map[string]bool{}
+		filteredRecords := []string{}
+		for _, record := range records {
+			key := string(c.KeyFromString(&buf, record))
+			buf.Reset()
+
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			filteredRecords = append(filteredRecords, record)
+		}
+
+		return filteredRecords
+	}
+}
+
+// WithTracing returns a filter set that wraps each run of fs in a span from the named tracer,
+// recording the number of records in and out as attributes.
+// Spans come from the global tracer provider, which is a no-op until one is configured.
+func WithTracing(fs FilterSet, tracerName string) FilterSet {
+	tracer := otel.Tracer(tracerName)
+
+	return func(records []string) []string {
+		_, span := tracer.Start(context.Background(), "FilterSet")
+		defer span.End()
+
+		filteredRecords := fs(records)
+		if span.IsRecording() {
+			span.SetAttributes(
+				attribute.Int("records.in", len(records)),
+				attribute.Int("records.out", len(filteredRecords)),
+			)
+		}
+
+		return filteredRecords
+	}
+}
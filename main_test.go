@@ -0,0 +1,2266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/text/language"
+)
+
+// sampleRecords mirrors the contrived records used in main.
+var sampleRecords = []string{
+	"Cat",
+	"A sentence is not a valid record.",
+	"Minotaur",
+	"cd5169bf-3649-4091-862b-c7ec1de92fd9-cd5169bf-3649-4091-862b-c7ec1de92fd9-cd5169bf-3649-4091-862b-c7ec1de92fd9",
+	"3412-3241",
+	"Dragon",
+	"Cat",
+}
+
+func TestFilterDuplicatesLocale(t *testing.T) {
+	tests := []struct {
+		name    string
+		tag     language.Tag
+		records []string
+		want    []string
+	}{
+		{"accent variants collapse", language.French, []string{"café", "cafe", "Café", "thé"}, []string{"café", "thé"}},
+		{"distinct records kept", language.English, []string{"Cat", "Dog"}, []string{"Cat", "Dog"}},
+		{"sample data", language.English, sampleRecords, []string{sampleRecords[0], sampleRecords[1], sampleRecords[2], sampleRecords[3], sampleRecords[4], sampleRecords[5]}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FilterDuplicatesLocale(tt.tag)(tt.records); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FilterDuplicatesLocale() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(previous)
+
+	got := WithTracing(FilterForAnimals, "filters")(sampleRecords)
+	if want := FilterForAnimals(sampleRecords); !reflect.DeepEqual(got, want) {
+		t.Fatalf("WithTracing() = %q, want %q", got, want)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d ended spans, want 1", len(spans))
+	}
+	attrs := map[attribute.Key]int64{}
+	for _, kv := range spans[0].Attributes() {
+		attrs[kv.Key] = kv.Value.AsInt64()
+	}
+	if attrs["records.in"] != int64(len(sampleRecords)) || attrs["records.out"] != int64(len(got)) {
+		t.Errorf("span attributes = %v, want records.in=%d records.out=%d", attrs, len(sampleRecords), len(got))
+	}
+	if name := spans[0].InstrumentationScope().Name; name != "filters" {
+		t.Errorf("tracer name = %q, want %q", name, "filters")
+	}
+}
+
+func TestFilterStreamIO(t *testing.T) {
+	long := strings.Repeat("x", 70000)
+
+	tests := []struct {
+		name    string
+		input   string
+		filters []Filter
+		want    string
+	}{
+		{"surviving lines", "Cat\nDragon\nA sentence\nDog", []Filter{FilterMagicalCreatures, FilterWords}, "Cat\nDog\n"},
+		{"trailing newline and carriage returns", "Cat\r\nDog\r\n", nil, "Cat\nDog\n"},
+		{"empty lines kept", "Cat\n\nDog\n", nil, "Cat\n\nDog\n"},
+		{"empty input", "", nil, ""},
+		{"lines longer than the scanner limit", long + "\nCat\n", nil, long + "\nCat\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := FilterStreamIO(strings.NewReader(tt.input), &out, tt.filters...); err != nil {
+				t.Fatalf("FilterStreamIO() error = %v", err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("FilterStreamIO() wrote %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestSymmetricDifference(t *testing.T) {
+	// A long two-part record is an ID but too long to be an animal.
+	longID := strings.Repeat("a", 40) + "-" + strings.Repeat("b", 40)
+	records := append(append([]string{}, sampleRecords...), longID)
+
+	got := SymmetricDifference(records, FilterForAnimals, FilterForIDs)
+	want := []string{"Cat", "3412-3241", longID}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SymmetricDifference() = %q, want %q", got, want)
+	}
+
+	same := SymmetricDifference(records, FilterForAnimals, FilterForAnimals)
+	if len(same) != 0 {
+		t.Errorf("SymmetricDifference() of a set with itself = %q, want none", same)
+	}
+}
+
+func TestFilterControlChars(t *testing.T) {
+	tests := []struct {
+		name            string
+		record          string
+		allowWhitespace bool
+		want            bool
+	}{
+		{"NUL rejected", "Cat\x00", false, false},
+		{"NUL rejected when whitespace allowed", "Cat\x00", true, false},
+		{"normal record", "Cat", false, true},
+		{"tab rejected", "Cat\tDog", false, false},
+		{"tab allowed", "Cat\tDog", true, true},
+		{"newline allowed", "Cat\nDog", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FilterControlChars(tt.allowWhitespace)(tt.record); got != tt.want {
+				t.Errorf("FilterControlChars(%v)(%q) = %v, want %v", tt.allowWhitespace, tt.record, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyParallel(t *testing.T) {
+	sets := map[string]FilterSet{
+		"animals": FilterForAnimals,
+		"ids":     FilterForIDs,
+		"all":     func(records []string) []string { return records },
+	}
+
+	// Run under -race to check the shared result map is safe.
+	want := Classify(sampleRecords, sets)
+	for i := 0; i < 10; i++ {
+		if got := ClassifyParallel(sampleRecords, sets); !reflect.DeepEqual(got, want) {
+			t.Fatalf("ClassifyParallel() = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestFilterMonotonic(t *testing.T) {
+	parse := func(s string) (int, bool) {
+		v, err := strconv.Atoi(s)
+		return v, err == nil
+	}
+
+	tests := []struct {
+		name    string
+		records []string
+		want    []string
+	}{
+		{"out of order value dropped", []string{"1", "3", "2", "4"}, []string{"1", "3", "4"}},
+		{"repeats dropped", []string{"1", "1", "2"}, []string{"1", "2"}},
+		{"unparseable dropped", []string{"Cat", "1", "Dog", "2"}, []string{"1", "2"}},
+		{"negative start", []string{"-5", "-6", "0"}, []string{"-5", "0"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FilterMonotonic(parse)(tt.records); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FilterMonotonic() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	columns := Classify([]string{"Cat", "Dog", "ab-cd", "Dragon"}, map[string]FilterSet{
+		"animals": FilterForAnimals,
+		"ids":     FilterForIDs,
+	})
+
+	var out bytes.Buffer
+	if err := WriteCSV(&out, columns); err != nil {
+		t.Fatalf("WriteCSV() error = %v", err)
+	}
+
+	want := "animals,ids\nCat,ab-cd\nDog,\nab-cd,\n"
+	if out.String() != want {
+		t.Errorf("WriteCSV() wrote %q, want %q", out.String(), want)
+	}
+}
+
+func TestSuffixDuplicates(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []string
+		want    []string
+	}{
+		{"sample data", sampleRecords, append(append([]string{}, sampleRecords[:6]...), "Cat-2")},
+		{"first occurrence unchanged", []string{"Cat", "Cat", "Cat"}, []string{"Cat", "Cat-2", "Cat-3"}},
+		{"existing suffix skipped", []string{"Cat", "Cat-2", "Cat"}, []string{"Cat", "Cat-2", "Cat-3"}},
+		{"renamed records don't collide", []string{"Cat", "Cat", "Cat-2", "Cat-2"}, []string{"Cat", "Cat-3", "Cat-2", "Cat-2-2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SuffixDuplicates("-")(tt.records)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SuffixDuplicates() = %q, want %q", got, tt.want)
+			}
+			if unique := FilterDuplicates(got); len(unique) != len(got) {
+				t.Errorf("SuffixDuplicates() left duplicates in %q", got)
+			}
+		})
+	}
+}
+
+func TestApplyMappers(t *testing.T) {
+	records := []string{"Cat", "CAT", "cat", "Dog"}
+
+	lowered := ApplyMappers(records, strings.ToLower)
+	if want := []string{"cat", "cat", "cat", "dog"}; !reflect.DeepEqual(lowered, want) {
+		t.Errorf("ApplyMappers() = %q, want %q", lowered, want)
+	}
+
+	if got, want := ApplyBulkFilters(lowered, FilterDuplicates), []string{"cat", "dog"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dedup after ApplyMappers() = %q, want %q", got, want)
+	}
+
+	chained := ApplyMappers([]string{" Cat "}, strings.TrimSpace, strings.ToUpper)
+	if want := []string{"CAT"}; !reflect.DeepEqual(chained, want) {
+		t.Errorf("ApplyMappers() with two mappers = %q, want %q", chained, want)
+	}
+}
+
+func TestSplitRecords(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []string
+		want    []string
+	}{
+		{"three values", []string{"Cat|Dog|Bird"}, []string{"Cat", "Dog", "Bird"}},
+		{"empty fragments dropped", []string{"|Cat||Dog|"}, []string{"Cat", "Dog"}},
+		{"order preserved across records", []string{"Cat|Dog", "Bird"}, []string{"Cat", "Dog", "Bird"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SplitRecords("|")(tt.records); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SplitRecords() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRejectBatchIf(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []string
+		want    []string
+	}{
+		{"one forbidden record rejects the batch", []string{"Cat", "Dragon", "Dog"}, []string{}},
+		{"all pass through", []string{"Cat", "Dog"}, []string{"Cat", "Dog"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RejectBatchIf(FilterMagicalCreatures)(tt.records); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("RejectBatchIf() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterDuplicatesWithCounts(t *testing.T) {
+	unique, counts := FilterDuplicatesWithCounts(sampleRecords)
+
+	if want := FilterDuplicates(sampleRecords); !reflect.DeepEqual(unique, want) {
+		t.Errorf("FilterDuplicatesWithCounts() unique = %q, want %q", unique, want)
+	}
+	if want := []int{2, 1, 1, 1, 1, 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("FilterDuplicatesWithCounts() counts = %v, want %v", counts, want)
+	}
+}
+
+func TestFilterIP(t *testing.T) {
+	tests := []struct {
+		record  string
+		version int
+		want    bool
+	}{
+		{"192.168.0.1", 0, true},
+		{"192.168.0.1", 4, true},
+		{"192.168.0.1", 6, false},
+		{"2001:db8::1", 0, true},
+		{"2001:db8::1", 4, false},
+		{"2001:db8::1", 6, true},
+		{"::ffff:1.2.3.4", 4, false},
+		{"::ffff:1.2.3.4", 6, true},
+		{"::ffff:1.2.3.4", 0, true},
+		{"fe80::1%eth0", 0, false},
+		{"fe80::1%eth0", 6, false},
+		{"Cat", 0, false},
+		{"3412-3241", 4, false},
+		{"256.1.1.1", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/v%d", tt.record, tt.version), func(t *testing.T) {
+			if got := FilterIP(tt.version)(tt.record); got != tt.want {
+				t.Errorf("FilterIP(%d)(%q) = %v, want %v", tt.version, tt.record, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollapseByClass(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []string
+		want    []string
+	}{
+		{"sample data", sampleRecords, []string{"Cat", "A sentence is not a valid record.", "Minotaur", sampleRecords[3], "Dragon"}},
+		{"non-members untouched", []string{"Dragon", "Cat", "Dog", "A b", "Unicorn"}, []string{"Dragon", "Cat", "A b", "Unicorn"}},
+		{"no members", []string{"Dragon", "A b"}, []string{"Dragon", "A b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CollapseByClass(tt.records, FilterForAnimals); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CollapseByClass() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExplain(t *testing.T) {
+	filters := []NamedFilter{
+		{Name: "magical", Filter: FilterMagicalCreatures},
+		{Name: "length", Filter: FilterStringLength},
+		{Name: "ints", Filter: FilterInts},
+		{Name: "words", Filter: FilterWords},
+		{Name: "ids", Filter: FilterIDs},
+	}
+
+	tests := []struct {
+		record string
+		want   []Decision
+	}{
+		{sampleRecords[3], []Decision{{"magical", true}, {"length", false}, {"ints", true}, {"words", true}, {"ids", false}}},
+		{"Cat", []Decision{{"magical", true}, {"length", true}, {"ints", true}, {"words", true}, {"ids", false}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.record, func(t *testing.T) {
+			if got := Explain(tt.record, filters...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Explain() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequireMinCount(t *testing.T) {
+	records, err := RequireMinCount(7)(sampleRecords)
+	if err != nil {
+		t.Fatalf("RequireMinCount(7) error = %v", err)
+	}
+	if !reflect.DeepEqual(records, sampleRecords) {
+		t.Errorf("RequireMinCount(7) = %q, want records unchanged", records)
+	}
+
+	_, err = RequireMinCount(8)(sampleRecords)
+	if err == nil || !strings.Contains(err.Error(), "8") || !strings.Contains(err.Error(), "7") {
+		t.Errorf("RequireMinCount(8) error = %v, want expected and actual counts", err)
+	}
+}
+
+func TestFilterHostname(t *testing.T) {
+	tests := []struct {
+		record string
+		want   bool
+	}{
+		{"example.com", true},
+		{"localhost", true},
+		{"a-b.example.com", true},
+		{strings.Repeat("a", 63) + ".com", true},
+		{strings.Repeat("a", 64) + ".com", false},
+		{"-example.com", false},
+		{"example-.com", false},
+		{"exa_mple.com", false},
+		{"example..com", false},
+		{"", false},
+		{strings.Repeat("a.", 127) + "a", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.record, func(t *testing.T) {
+			if got := FilterHostname()(tt.record); got != tt.want {
+				t.Errorf("FilterHostname()(%q) = %v, want %v", tt.record, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterWeightedSample(t *testing.T) {
+	rarity := func(_ string, freq int) float64 { return 1 / float64(freq) }
+	records := []string{"Cat", "Cat", "Cat", "Cat", "Dog", "Bird", "Bird"}
+
+	first := FilterWeightedSample(rarity, rand.New(rand.NewSource(42)))(records)
+	second := FilterWeightedSample(rarity, rand.New(rand.NewSource(42)))(records)
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("FilterWeightedSample() with the same seed = %q and %q, want identical", first, second)
+	}
+	if !toSet(first)["Dog"] {
+		t.Errorf("FilterWeightedSample() = %q, want the unique record kept with weight 1", first)
+	}
+
+	always := FilterWeightedSample(func(string, int) float64 { return 2 }, rand.New(rand.NewSource(1)))(records)
+	if !reflect.DeepEqual(always, records) {
+		t.Errorf("FilterWeightedSample() with weight above 1 = %q, want every record", always)
+	}
+	never := FilterWeightedSample(func(string, int) float64 { return -1 }, rand.New(rand.NewSource(1)))(records)
+	if len(never) != 0 {
+		t.Errorf("FilterWeightedSample() with weight below 0 = %q, want none", never)
+	}
+}
+
+func TestListFilterSets(t *testing.T) {
+	names := ListFilterSets()
+	if want := []string{"animals", "ids"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("ListFilterSets() = %q, want %q", names, want)
+	}
+
+	names[0] = "changed"
+	if again := ListFilterSets(); again[0] != "animals" {
+		t.Errorf("ListFilterSets() = %q after mutating a previous result, want a fresh copy", again)
+	}
+}
+
+func TestRequireGrouped(t *testing.T) {
+	firstLetter := func(s string) string { return s[:1] }
+
+	grouped := []string{"Cat", "Cow", "Dog", "Donkey", "Bird"}
+	if got, err := RequireGrouped(firstLetter)(grouped); err != nil || !reflect.DeepEqual(got, grouped) {
+		t.Errorf("RequireGrouped() = %q, %v, want records unchanged", got, err)
+	}
+
+	_, err := RequireGrouped(firstLetter)([]string{"Cat", "Dog", "Cow"})
+	if err == nil || !strings.Contains(err.Error(), `"C"`) {
+		t.Errorf("RequireGrouped() error = %v, want it to name key \"C\"", err)
+	}
+}
+
+func TestFilterValidUTF8(t *testing.T) {
+	tests := []struct {
+		record string
+		want   bool
+	}{
+		{"Cat", true},
+		{"café 日本", true},
+		{"Cat\xff", false},
+		{"\xc3\x28", false},
+	}
+
+	for _, tt := range tests {
+		if got := FilterValidUTF8()(tt.record); got != tt.want {
+			t.Errorf("FilterValidUTF8()(%q) = %v, want %v", tt.record, got, tt.want)
+		}
+	}
+}
+
+func TestFilterLengthOutliers(t *testing.T) {
+	got := FilterLengthOutliers(2)(sampleRecords)
+	want := []string{"Cat", "A sentence is not a valid record.", "Minotaur", "3412-3241", "Dragon", "Cat"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterLengthOutliers(2) = %q, want %q", got, want)
+	}
+
+	uniform := []string{"Cat", "Dog", "Owl"}
+	if got := FilterLengthOutliers(0)(uniform); !reflect.DeepEqual(got, uniform) {
+		t.Errorf("FilterLengthOutliers(0) on equal lengths = %q, want %q", got, uniform)
+	}
+}
+
+func TestApplyFiltersPriority(t *testing.T) {
+	records := []string{"Cat", "Dragon", "A sentence", "12"}
+	onlyCat := func(s string) bool { return s == "Cat" }
+
+	tests := []struct {
+		name    string
+		filters []NamedFilter
+		want    map[string]int
+	}{
+		{
+			"first failing filter blamed",
+			[]NamedFilter{{Name: "magical", Filter: FilterMagicalCreatures}, {Name: "words", Filter: FilterWords}, {Name: "ints", Filter: FilterInts}, {Name: "cat", Filter: onlyCat}},
+			map[string]int{"magical": 1, "words": 1, "ints": 1},
+		},
+		{
+			"higher priority filter blamed",
+			[]NamedFilter{{Name: "magical", Filter: FilterMagicalCreatures}, {Name: "words", Filter: FilterWords}, {Name: "ints", Filter: FilterInts}, {Name: "cat", Filter: onlyCat, Priority: 1}},
+			map[string]int{"cat": 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, rejections := ApplyFiltersPriority(records, tt.filters)
+			if want := []string{"Cat"}; !reflect.DeepEqual(kept, want) {
+				t.Errorf("ApplyFiltersPriority() kept = %q, want %q", kept, want)
+			}
+			if !reflect.DeepEqual(rejections, tt.want) {
+				t.Errorf("ApplyFiltersPriority() rejections = %v, want %v", rejections, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatefulDeduper(t *testing.T) {
+	d := NewStatefulDeduper(0)
+	if got, want := d.Filter([]string{"Cat", "Dog", "Cat"}), []string{"Cat", "Dog"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("first batch = %q, want %q", got, want)
+	}
+	if got, want := d.Filter([]string{"Cat", "Bird"}), []string{"Bird"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("second batch = %q, want %q", got, want)
+	}
+
+	d.Reset()
+	if got, want := d.Filter([]string{"Cat"}), []string{"Cat"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("batch after Reset = %q, want %q", got, want)
+	}
+
+	bounded := NewStatefulDeduper(2)
+	bounded.Filter([]string{"Cat", "Dog", "Bird"})
+	if got, want := bounded.Filter([]string{"Cat", "Bird"}), []string{"Cat"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("bounded batch = %q, want the evicted oldest key kept again: %q", got, want)
+	}
+}
+
+func TestFilterJSON(t *testing.T) {
+	tests := []struct {
+		record string
+		want   bool
+	}{
+		{`{"id": 1}`, true},
+		{`[1, 2, 3]`, true},
+		// Bare numbers are valid JSON documents, so they are kept.
+		{`42`, true},
+		{`{id: 1}`, false},
+		{`{"id": 1`, false},
+		{"Cat", false},
+	}
+
+	for _, tt := range tests {
+		if got := FilterJSON()(tt.record); got != tt.want {
+			t.Errorf("FilterJSON()(%q) = %v, want %v", tt.record, got, tt.want)
+		}
+	}
+}
+
+func TestRequireDuplicateRatioBelow(t *testing.T) {
+	// The sample data has one duplicate in seven records.
+	if got, err := RequireDuplicateRatioBelow(0.2)(sampleRecords); err != nil || !reflect.DeepEqual(got, sampleRecords) {
+		t.Errorf("RequireDuplicateRatioBelow(0.2) = %q, %v, want records unchanged", got, err)
+	}
+	if _, err := RequireDuplicateRatioBelow(0.1)(sampleRecords); err == nil {
+		t.Error("RequireDuplicateRatioBelow(0.1) error = nil, want an error for a 1/7 ratio")
+	}
+	if _, err := RequireDuplicateRatioBelow(0)([]string{}); err != nil {
+		t.Errorf("RequireDuplicateRatioBelow(0) on an empty batch error = %v, want nil", err)
+	}
+}
+
+func TestFilterReservoir(t *testing.T) {
+	records := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+
+	got := FilterReservoir(3, rand.New(rand.NewSource(1)))(records)
+	again := FilterReservoir(3, rand.New(rand.NewSource(1)))(records)
+	if len(got) != 3 || !reflect.DeepEqual(got, again) {
+		t.Errorf("FilterReservoir(3) = %q and %q, want the same 3 records for the same seed", got, again)
+	}
+	if !sort.StringsAreSorted(got) {
+		t.Errorf("FilterReservoir(3) = %q, want input order preserved", got)
+	}
+
+	if all := FilterReservoir(10, rand.New(rand.NewSource(1)))(records); !reflect.DeepEqual(all, records) {
+		t.Errorf("FilterReservoir(10) = %q, want every record", all)
+	}
+}
+
+func TestFilterSemVer(t *testing.T) {
+	tests := []struct {
+		record string
+		want   bool
+	}{
+		{"1.2.3", true},
+		{"1.2.3-rc.1+build5", true},
+		{"0.0.0", true},
+		{"1.2", false},
+		// The leading "v" is not part of the SemVer grammar.
+		{"v1.2.3", false},
+		{"01.2.3", false},
+		{"1.2.3-01", false},
+		{"1.2.3+", false},
+		{"1.2.3-rc..1", false},
+	}
+
+	for _, tt := range tests {
+		if got := FilterSemVer()(tt.record); got != tt.want {
+			t.Errorf("FilterSemVer()(%q) = %v, want %v", tt.record, got, tt.want)
+		}
+	}
+}
+
+func TestFilterMaxRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		n       int
+		records []string
+		want    []string
+	}{
+		{"run longer than n", 2, []string{"a", "a", "a", "a", "b"}, []string{"a", "a", "b"}},
+		{"runs at and under n", 2, []string{"a", "a", "b", "a"}, []string{"a", "a", "b", "a"}},
+		{"adjacent dedup", 1, []string{"a", "a", "b", "b", "a"}, []string{"a", "b", "a"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FilterMaxRun(tt.n)(tt.records); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FilterMaxRun(%d) = %q, want %q", tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithFallback(t *testing.T) {
+	nothing := func([]string) []string { return []string{} }
+	called := false
+	fallback := func(records []string) []string {
+		called = true
+		return FilterForAnimals(records)
+	}
+
+	if got, want := WithFallback(nothing, fallback)(sampleRecords), FilterForAnimals(sampleRecords); !reflect.DeepEqual(got, want) || !called {
+		t.Errorf("WithFallback() with an empty primary = %q, want fallback result %q", got, want)
+	}
+
+	called = false
+	if got, want := WithFallback(FilterForAnimals, fallback)(sampleRecords), FilterForAnimals(sampleRecords); !reflect.DeepEqual(got, want) || called {
+		t.Errorf("WithFallback() with a non-empty primary = %q (fallback called: %v), want %q", got, called, want)
+	}
+}
+
+func TestFilterCurrency(t *testing.T) {
+	tests := []struct {
+		symbols []string
+		record  string
+		want    bool
+	}{
+		{nil, "$1,234.56", true},
+		{nil, "€99", true},
+		{nil, "1234", true},
+		{nil, "£0.5", true},
+		{nil, "$1,23.45", false},
+		{nil, "¥100", false},
+		{nil, "$", false},
+		{[]string{"¥"}, "¥100", true},
+		{[]string{"¥"}, "$100", false},
+	}
+
+	for _, tt := range tests {
+		if got := FilterCurrency(tt.symbols...)(tt.record); got != tt.want {
+			t.Errorf("FilterCurrency(%q)(%q) = %v, want %v", tt.symbols, tt.record, got, tt.want)
+		}
+	}
+}
+
+func TestBatchChecksum(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []string
+		same bool
+	}{
+		{"identical batches", []string{"Cat", "Dog"}, []string{"Cat", "Dog"}, true},
+		{"reordered batch", []string{"Cat", "Dog"}, []string{"Dog", "Cat"}, false},
+		{"shifted boundary", []string{"ab", "c"}, []string{"a", "bc"}, false},
+		{"empty record", []string{"Cat"}, []string{"Cat", ""}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := BatchChecksum(tt.a) == BatchChecksum(tt.b); got != tt.same {
+				t.Errorf("BatchChecksum(%q) == BatchChecksum(%q) is %v, want %v", tt.a, tt.b, got, tt.same)
+			}
+		})
+	}
+}
+
+func TestConditionalFilter(t *testing.T) {
+	// Short records must not be magical creatures; longer ones only need to be words.
+	short := func(s string) bool { return len(s) <= 6 }
+	f := ConditionalFilter(short, FilterMagicalCreatures, FilterWords)
+
+	tests := []struct {
+		record string
+		want   bool
+	}{
+		{"Dragon", false},
+		{"Cat", true},
+		{"Minotaur", true},
+		{"Elephant", true},
+		{"A sentence", false},
+	}
+
+	for _, tt := range tests {
+		if got := f(tt.record); got != tt.want {
+			t.Errorf("ConditionalFilter()(%q) = %v, want %v", tt.record, got, tt.want)
+		}
+	}
+}
+
+func TestFilterReferences(t *testing.T) {
+	valid := map[string]struct{}{"u1": {}, "u2": {}}
+	extract := func(record string) string {
+		key, _, _ := strings.Cut(record, ",")
+		return key
+	}
+
+	records := []string{"u1,order-1", "u3,order-2", "u2,order-3", "order-4"}
+	want := []string{"u1,order-1", "u2,order-3"}
+	if got := FilterReferences(valid, extract)(records); !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterReferences() = %q, want %q", got, want)
+	}
+}
+
+func TestClassifyWithProvenance(t *testing.T) {
+	sets := map[string]FilterSet{
+		"animals": FilterForAnimals,
+		"mundane": func(records []string) []string { return ApplyFilters(records, FilterMagicalCreatures) },
+	}
+
+	got := ClassifyWithProvenance([]string{"Dragon", "Cat", "12", "Dragon"}, sets)
+	want := []Provenance{
+		{Record: "Cat", Sets: []string{"animals", "mundane"}},
+		{Record: "12", Sets: []string{"mundane"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ClassifyWithProvenance() = %+v, want %+v", got, want)
+	}
+}
+
+func TestFillSequenceGaps(t *testing.T) {
+	parse := func(s string) (int, bool) {
+		n, err := strconv.Atoi(s)
+		return n, err == nil
+	}
+	placeholder := func(n int) string { return "missing-" + strconv.Itoa(n) }
+
+	tests := []struct {
+		name    string
+		maxGap  int
+		records []string
+		want    []string
+	}{
+		{"fills small gaps", 5, []string{"1", "3", "4", "7"}, []string{"1", "missing-2", "3", "4", "missing-5", "missing-6", "7"}},
+		{"drops out-of-order and unparseable", 5, []string{"1", "x", "3", "2", "3", "4"}, []string{"1", "missing-2", "3", "4"}},
+		{"leaves gaps over maxGap unfilled", 2, []string{"1", "5", "7", "1000000000"}, []string{"1", "5", "missing-6", "7", "1000000000"}},
+		{"zero maxGap has no cap", 0, []string{"1", "4"}, []string{"1", "missing-2", "missing-3", "4"}},
+		{"negative maxGap has no cap", -1, []string{"1", "3"}, []string{"1", "missing-2", "3"}},
+		// The gap between these is 2^64-1, which overflows an int difference.
+		{"extreme pair", 5, []string{strconv.Itoa(math.MinInt), strconv.Itoa(math.MaxInt)}, []string{strconv.Itoa(math.MinInt), strconv.Itoa(math.MaxInt)}},
+		{"extreme negative gap", 5, []string{strconv.Itoa(math.MinInt), strconv.Itoa(math.MinInt + 2)}, []string{strconv.Itoa(math.MinInt), "missing-" + strconv.Itoa(math.MinInt+1), strconv.Itoa(math.MinInt + 2)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FillSequenceGaps(parse, placeholder, tt.maxGap)(tt.records); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FillSequenceGaps(maxGap=%d) = %q, want %q", tt.maxGap, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterMAC(t *testing.T) {
+	tests := []struct {
+		record string
+		want   bool
+	}{
+		{"00:1A:2b:3c:4d:5e", true},
+		{"00-1a-2b-3c-4d-5e", true},
+		{"001a.2b3c.4d5e", true},
+		{"00:1a:2b:3c:4d", false},
+		{"00:1a:2b:3c:4d:zz", false},
+		{"Cat", false},
+	}
+
+	for _, tt := range tests {
+		if got := FilterMAC()(tt.record); got != tt.want {
+			t.Errorf("FilterMAC()(%q) = %v, want %v", tt.record, got, tt.want)
+		}
+	}
+}
+
+func TestFilterHashDownsample(t *testing.T) {
+	records := make([]string, 10000)
+	for i := range records {
+		records[i] = fmt.Sprintf("record-%d", i)
+	}
+
+	got := FilterHashDownsample(0.1)(records)
+	if n := len(got); n < 800 || n > 1200 {
+		t.Errorf("FilterHashDownsample(0.1) kept %d of %d records, want roughly 1000", n, len(records))
+	}
+
+	// A record's fate depends only on its value, so a sub-batch gives the matching subset.
+	kept := toSet(got)
+	for _, r := range FilterHashDownsample(0.1)(records[:100]) {
+		if !kept[r] {
+			t.Errorf("FilterHashDownsample(0.1) kept %q in a sub-batch but not in the full batch", r)
+		}
+	}
+
+	if got := FilterHashDownsample(0)(records); len(got) != 0 {
+		t.Errorf("FilterHashDownsample(0) kept %d records, want 0", len(got))
+	}
+	if got := FilterHashDownsample(1)(records); len(got) != len(records) {
+		t.Errorf("FilterHashDownsample(1) kept %d records, want %d", len(got), len(records))
+	}
+}
+
+func TestBenchmark(t *testing.T) {
+	if got := Benchmark(FilterForAnimals, sampleRecords, 0); got != (Stats{}) {
+		t.Errorf("Benchmark() with 0 iterations = %+v, want zero Stats", got)
+	}
+
+	s := Benchmark(FilterForAnimals, sampleRecords, 20)
+	if !(s.Min <= s.P50 && s.P50 <= s.P95 && s.P95 <= s.Max) || s.Mean < s.Min || s.Mean > s.Max {
+		t.Errorf("Benchmark() = %+v, want Min <= P50 <= P95 <= Max and Min <= Mean <= Max", s)
+	}
+}
+
+func TestRequireExactlyOne(t *testing.T) {
+	validators := map[string]Filter{
+		"int":  func(s string) bool { _, err := strconv.Atoi(s); return err == nil },
+		"word": func(s string) bool { return s != "" && !strings.ContainsAny(s, " 0123456789") },
+	}
+
+	tests := []struct {
+		name    string
+		records []string
+		wantErr bool
+	}{
+		{"each matches one", []string{"12", "Cat"}, false},
+		{"matches none", []string{"12", "A sentence"}, true},
+		{"empty batch", []string{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RequireExactlyOne(validators)(tt.records)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RequireExactlyOne() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.records) {
+				t.Errorf("RequireExactlyOne() = %q, want records unchanged", got)
+			}
+		})
+	}
+
+	overlapping := map[string]Filter{"any": func(string) bool { return true }, "cat": func(s string) bool { return s == "Cat" }}
+	if _, err := RequireExactlyOne(overlapping)([]string{"Cat"}); err == nil {
+		t.Error("RequireExactlyOne() error = nil for a record matching two validators")
+	}
+}
+
+func TestApplyFiltersBytes(t *testing.T) {
+	records := [][]byte{}
+	for _, r := range sampleRecords {
+		records = append(records, []byte(r))
+	}
+
+	got := ApplyFiltersBytes(records, FilterStringLengthBytes, FilterWordsBytes)
+	want := ApplyFilters(sampleRecords, FilterStringLength, FilterWords)
+	if len(got) != len(want) {
+		t.Fatalf("ApplyFiltersBytes() kept %d records, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if string(got[i]) != want[i] {
+			t.Errorf("ApplyFiltersBytes()[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func benchmarkRecords() []string {
+	records := make([]string, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		records = append(records, sampleRecords[i%len(sampleRecords)])
+	}
+
+	return records
+}
+
+func BenchmarkApplyFilters(b *testing.B) {
+	records := benchmarkRecords()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		ApplyFilters(records, FilterStringLength, FilterWords)
+	}
+}
+
+func BenchmarkApplyFiltersBytes(b *testing.B) {
+	records := [][]byte{}
+	for _, r := range benchmarkRecords() {
+		records = append(records, []byte(r))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		ApplyFiltersBytes(records, FilterStringLengthBytes, FilterWordsBytes)
+	}
+}
+
+func TestFilterDedupByJSONField(t *testing.T) {
+	records := []string{
+		`{"id": 1, "name": "Cat"}`,
+		`{"id":1,"name":"Dog"}`,
+		`{"id": 2, "name": "Cat"}`,
+		`{"name": "Owl"}`,
+		`not json`,
+		`[1, 2]`,
+		`{"id": "1"}`,
+	}
+	want := []string{`{"id": 1, "name": "Cat"}`, `{"id": 2, "name": "Cat"}`, `{"id": "1"}`}
+
+	if got := FilterDedupByJSONField("id")(records); !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterDedupByJSONField(\"id\") = %q, want %q", got, want)
+	}
+}
+
+func TestApplyFiltersMode(t *testing.T) {
+	filters := []NamedFilter{
+		{Name: "magical", Filter: FilterMagicalCreatures},
+		{Name: "length", Filter: func(s string) bool { return len(s) <= 5 }},
+		{Name: "words", Filter: FilterWords},
+	}
+	records := []string{"Cat", "Dragon", "A sentence", "Elephant"}
+
+	shortKept, shortFailures := ApplyFiltersMode(records, ShortCircuit, filters...)
+	allKept, allFailures := ApplyFiltersMode(records, EvaluateAll, filters...)
+
+	if want := []string{"Cat"}; !reflect.DeepEqual(shortKept, want) || !reflect.DeepEqual(allKept, want) {
+		t.Errorf("ApplyFiltersMode() kept %q (ShortCircuit) and %q (EvaluateAll), want %q", shortKept, allKept, want)
+	}
+
+	wantShort := map[string][]string{"Dragon": {"magical"}, "A sentence": {"length"}, "Elephant": {"length"}}
+	if !reflect.DeepEqual(shortFailures, wantShort) {
+		t.Errorf("ApplyFiltersMode(ShortCircuit) failures = %v, want %v", shortFailures, wantShort)
+	}
+	wantAll := map[string][]string{"Dragon": {"magical", "length"}, "A sentence": {"length", "words"}, "Elephant": {"length"}}
+	if !reflect.DeepEqual(allFailures, wantAll) {
+		t.Errorf("ApplyFiltersMode(EvaluateAll) failures = %v, want %v", allFailures, wantAll)
+	}
+}
+
+func TestNormalizePhones(t *testing.T) {
+	tests := []struct {
+		record string
+		want   string
+	}{
+		{"(415) 555-2671", "+14155552671"},
+		{"+14155552671", "+14155552671"},
+		{"415.555.2671", "+14155552671"},
+		{"0044 20 7946 0958", "+442079460958"},
+		{"+44 20 7946 0958", "+442079460958"},
+		// IDs, dates and short digit runs aren't phone numbers.
+		{"3412-3241", "3412-3241"},
+		{"2024-01-02", "2024-01-02"},
+		{"12345678", "12345678"},
+		{"555-2671", "555-2671"},
+		{"Cat", "Cat"},
+	}
+
+	for _, tt := range tests {
+		if got := NormalizePhones("+1")([]string{tt.record}); !reflect.DeepEqual(got, []string{tt.want}) {
+			t.Errorf("NormalizePhones(\"+1\")(%q) = %q, want %q", tt.record, got, tt.want)
+		}
+	}
+
+	if got := NormalizePhones("+1")(sampleRecords); !reflect.DeepEqual(got, sampleRecords) {
+		t.Errorf("NormalizePhones(\"+1\") on the sample records = %q, want them unchanged", got)
+	}
+
+	deduped := ApplyBulkFilters(NormalizePhones("+1")([]string{"(415) 555-2671", "+14155552671"}), FilterDuplicates)
+	if want := []string{"+14155552671"}; !reflect.DeepEqual(deduped, want) {
+		t.Errorf("NormalizePhones() then FilterDuplicates = %q, want %q", deduped, want)
+	}
+}
+
+func TestLengthBucketedFilter(t *testing.T) {
+	f := LengthBucketedFilter([]LengthBucket{
+		{MaxLen: 3, Filter: func(s string) bool { return s == "Cat" }},
+		{MaxLen: 10, Filter: FilterWords},
+	})
+
+	tests := []struct {
+		record string
+		want   bool
+	}{
+		{"Cat", true},
+		{"Dog", false},
+		{"Elephant", true},
+		{"Two words", false},
+		{"Hippopotamus", false},
+	}
+
+	for _, tt := range tests {
+		if got := f(tt.record); got != tt.want {
+			t.Errorf("LengthBucketedFilter()(%q) = %v, want %v", tt.record, got, tt.want)
+		}
+	}
+}
+
+func TestLabelDuplicateGroups(t *testing.T) {
+	got := LabelDuplicateGroups([]string{"Cat", "Dog", "Cat", "Owl", "Dog"})
+	want := []DuplicateGroup{
+		{Record: "Cat", Group: 0},
+		{Record: "Dog", Group: 1},
+		{Record: "Cat", Group: 0},
+		{Record: "Owl", Group: 2},
+		{Record: "Dog", Group: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LabelDuplicateGroups() = %+v, want %+v", got, want)
+	}
+}
+
+func TestRetryBuild(t *testing.T) {
+	calls := 0
+	flaky := func() (Filter, error) {
+		calls++
+		if calls < 3 {
+			return nil, errors.New("resource unavailable")
+		}
+		return FilterWords, nil
+	}
+
+	f, err := RetryBuild(flaky, 3, time.Millisecond)
+	if err != nil || f == nil || calls != 3 {
+		t.Fatalf("RetryBuild() = %v after %d calls, want a filter after 3 calls", err, calls)
+	}
+	if !f("Cat") {
+		t.Error("RetryBuild() returned a filter that rejects \"Cat\"")
+	}
+
+	calls = 0
+	if _, err := RetryBuild(flaky, 2, time.Millisecond); err == nil || calls != 2 {
+		t.Errorf("RetryBuild() with 2 attempts error = %v after %d calls, want the last error after 2 calls", err, calls)
+	}
+	if _, err := RetryBuild(flaky, 0, 0); err == nil {
+		t.Error("RetryBuild() with 0 attempts error = nil, want an error")
+	}
+}
+
+func TestFixedWidth(t *testing.T) {
+	widths := []int{3, 2, 4}
+	records := []string{"CAT01blue", "DOG2blue", "OWL03green"}
+
+	if got, want := FilterFixedWidth(widths)(records), []string{"CAT01blue"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterFixedWidth() = %q, want %q", got, want)
+	}
+
+	fields, ok := ParseFixedWidth("CAT01blue", widths)
+	if want := []string{"CAT", "01", "blue"}; !ok || !reflect.DeepEqual(fields, want) {
+		t.Errorf("ParseFixedWidth() = %q, %v, want %q, true", fields, ok, want)
+	}
+	if _, ok := ParseFixedWidth("DOG2blue", widths); ok {
+		t.Error("ParseFixedWidth() of a short record ok = true, want false")
+	}
+}
+
+func TestWithCircuitBreaker(t *testing.T) {
+	tests := []struct {
+		name     string
+		records  []string
+		wantTrip bool
+	}{
+		// FilterForAnimals rejects 4 of the 7 sample records.
+		{"high rejection rate", sampleRecords, true},
+		{"low rejection rate", []string{"Cat", "Dog", "Owl", "Dragon"}, false},
+		{"empty batch", []string{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tripped := false
+			fs := WithCircuitBreaker(FilterForAnimals, 0.5, func(float64) { tripped = true })
+
+			if got, want := fs(tt.records), FilterForAnimals(tt.records); !reflect.DeepEqual(got, want) {
+				t.Errorf("WithCircuitBreaker() = %q, want %q", got, want)
+			}
+			if tripped != tt.wantTrip {
+				t.Errorf("WithCircuitBreaker() tripped = %v, want %v", tripped, tt.wantTrip)
+			}
+		})
+	}
+}
+
+func TestRequireOrder(t *testing.T) {
+	byLength := func(a, b string) bool { return len(a) < len(b) }
+
+	tests := []struct {
+		name    string
+		records []string
+		wantErr string
+	}{
+		{"in order", []string{"Cat", "Wolf", "Dragon"}, ""},
+		{"equal lengths", []string{"Cat", "Dog", "Wolf"}, ""},
+		{"out of order", []string{"Cat", "Dragon", "Wolf"}, `"Dragon" before "Wolf"`},
+		{"empty", []string{}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RequireOrder(byLength)(tt.records)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("RequireOrder() error = %v, want one containing %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.records) {
+				t.Errorf("RequireOrder() = %q, %v, want records unchanged", got, err)
+			}
+		})
+	}
+}
+
+func TestFilterBloomDedup(t *testing.T) {
+	if got, want := FilterBloomDedup(100, 0.01)(sampleRecords), FilterDuplicates(sampleRecords); !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterBloomDedup() = %q, want %q", got, want)
+	}
+
+	// Duplicates are always removed, and only a small fraction of unique records may be lost.
+	records := make([]string, 0, 2000)
+	for i := 0; i < 1000; i++ {
+		records = append(records, strconv.Itoa(i), strconv.Itoa(i))
+	}
+	got := FilterBloomDedup(1000, 0.01)(records)
+	if len(got) > 1000 || len(got) < 950 {
+		t.Errorf("FilterBloomDedup() kept %d of 1000 unique records, want between 950 and 1000", len(got))
+	}
+	if len(toSet(got)) != len(got) {
+		t.Error("FilterBloomDedup() kept a duplicate record")
+	}
+}
+
+func TestRequireContains(t *testing.T) {
+	if got, err := RequireContains("Cat", "Dragon")(sampleRecords); err != nil || !reflect.DeepEqual(got, sampleRecords) {
+		t.Errorf("RequireContains() = %q, %v, want records unchanged", got, err)
+	}
+	if _, err := RequireContains("Cat", "Unicorn")(sampleRecords); err == nil || !strings.Contains(err.Error(), "Unicorn") {
+		t.Errorf("RequireContains() error = %v, want one naming \"Unicorn\"", err)
+	}
+}
+
+func TestApplyFiltersTimed(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	slow := func(string) bool {
+		<-release
+		return false
+	}
+
+	kept, timedOut := ApplyFiltersTimed([]string{"Cat", "Dragon", "A sentence"}, 50*time.Millisecond,
+		NamedFilter{Name: "magical", Filter: FilterMagicalCreatures},
+		NamedFilter{Name: "slow", Filter: slow},
+		NamedFilter{Name: "words", Filter: FilterWords},
+	)
+
+	if want := []string{"Cat"}; !reflect.DeepEqual(kept, want) {
+		t.Errorf("ApplyFiltersTimed() kept = %q, want %q", kept, want)
+	}
+	if want := []string{"slow"}; !reflect.DeepEqual(timedOut, want) {
+		t.Errorf("ApplyFiltersTimed() timedOut = %q, want %q", timedOut, want)
+	}
+}
+
+func TestTransposeRecords(t *testing.T) {
+	got := TransposeRecords(",")([]string{"a,b,c", "d,e", "f"})
+	want := [][]string{{"a", "d", "f"}, {"b", "e", ""}, {"c", "", ""}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("TransposeRecords() = %q, want %q", got, want)
+	}
+
+	if got := TransposeRecords(",")([]string{}); len(got) != 0 {
+		t.Errorf("TransposeRecords() of no records = %q, want no columns", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []string
+		wantErr bool
+	}{
+		{"valid", []string{"Cat"}, false},
+		{"too large", []string{"Cat", "Dog", "Owl"}, true},
+		{"nil", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Validate(tt.records, NonNil(), MaxBatchSize(2)); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Every rule is run, so both failures are reported.
+	err := Validate([]string{"a", "b"}, MaxBatchSize(1), MaxBatchSize(0))
+	if joined, ok := err.(interface{ Unwrap() []error }); !ok || len(joined.Unwrap()) != 2 {
+		t.Errorf("Validate() error = %v, want 2 joined errors", err)
+	}
+}
+
+func TestRequireMaxCardinality(t *testing.T) {
+	// The sample data has 6 distinct records.
+	if got, err := RequireMaxCardinality(6)(sampleRecords); err != nil || !reflect.DeepEqual(got, sampleRecords) {
+		t.Errorf("RequireMaxCardinality(6) = %q, %v, want records unchanged", got, err)
+	}
+	if _, err := RequireMaxCardinality(5)(sampleRecords); err == nil {
+		t.Error("RequireMaxCardinality(5) error = nil, want an error for 6 distinct records")
+	}
+}
+
+func TestApplyTaggedFilters(t *testing.T) {
+	records := []TaggedRecord{
+		{Tag: "animals", Value: "Cat"},
+		{Tag: "animals", Value: "Dragon"},
+		{Tag: "ids", Value: "Cat"},
+		{Tag: "ids", Value: "3412-3241"},
+		{Tag: "other", Value: "anything"},
+	}
+	byTag := map[string]Filter{
+		"animals": FilterMagicalCreatures,
+		"ids":     func(s string) bool { return strings.Contains(s, "-") },
+	}
+
+	want := []TaggedRecord{
+		{Tag: "animals", Value: "Cat"},
+		{Tag: "ids", Value: "3412-3241"},
+		{Tag: "other", Value: "anything"},
+	}
+	if got := ApplyTaggedFilters(records, byTag); !reflect.DeepEqual(got, want) {
+		t.Errorf("ApplyTaggedFilters() = %+v, want %+v", got, want)
+	}
+}
+
+func TestFilterRareNGrams(t *testing.T) {
+	records := []string{"cat", "cats", "catty", "xyz", "a"}
+
+	tests := []struct {
+		name    string
+		n       int
+		minFreq int
+		want    []string
+	}{
+		{"drops records with rare bigrams", 2, 2, []string{"cat", "a"}},
+		{"every gram is frequent enough", 2, 1, records},
+		{"non-positive n keeps everything", 0, 5, records},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FilterRareNGrams(tt.n, tt.minFreq)(records); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FilterRareNGrams(%d, %d) = %q, want %q", tt.n, tt.minFreq, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunWithSnapshots(t *testing.T) {
+	final, snapshots := RunWithSnapshots([]string{"Cat", "Dragon", "A sentence", "Cat"},
+		FilterStage(FilterMagicalCreatures),
+		FilterStage(FilterWords),
+		BulkStage(FilterDuplicates),
+	)
+
+	want := [][]string{
+		{"Cat", "A sentence", "Cat"},
+		{"Cat", "Cat"},
+		{"Cat"},
+	}
+	if !reflect.DeepEqual(snapshots, want) {
+		t.Errorf("RunWithSnapshots() snapshots = %q, want %q", snapshots, want)
+	}
+	if !reflect.DeepEqual(final, want[len(want)-1]) {
+		t.Errorf("RunWithSnapshots() = %q, want the last snapshot %q", final, want[len(want)-1])
+	}
+}
+
+func TestFilterChecksumSuffix(t *testing.T) {
+	crc := func(s string) string { return fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(s))) }
+	valid := "Cat|" + crc("Cat")
+	// The content is changed after the checksum was computed.
+	tampered := "Cot|" + crc("Cat")
+	nested := "a|b|" + crc("a|b")
+
+	records := []string{valid, tampered, "Owl", nested}
+	want := []string{valid, nested}
+	if got := FilterChecksumSuffix("|", crc)(records); !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterChecksumSuffix() = %q, want %q", got, want)
+	}
+}
+
+func TestFilterSeq(t *testing.T) {
+	if got, want := slices.Collect(FilterSeq(sampleRecords, FilterMagicalCreatures, FilterWords)), ApplyFilters(sampleRecords, FilterMagicalCreatures, FilterWords); !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterSeq() = %q, want %q", got, want)
+	}
+
+	// Stopping early must skip the remaining records.
+	calls := 0
+	counting := func(string) bool {
+		calls++
+		return true
+	}
+	for range FilterSeq(sampleRecords, counting) {
+		break
+	}
+	if calls != 1 {
+		t.Errorf("FilterSeq() ran the filter %d times before the break, want 1", calls)
+	}
+}
+
+func TestJaccardSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b []string
+		want float64
+	}{
+		{[]string{"a", "b"}, []string{"b", "c"}, 1.0 / 3},
+		{[]string{"a", "a", "b"}, []string{"b", "a"}, 1},
+		{[]string{"a"}, []string{"b"}, 0},
+		{[]string{}, []string{}, 1},
+	}
+
+	for _, tt := range tests {
+		if got := JaccardSimilarity(tt.a, tt.b); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("JaccardSimilarity(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestApplySelective(t *testing.T) {
+	short := func(s string) bool { return len(s) <= 6 }
+	got := ApplySelective([]string{"Cat", "Dragon", "Minotaur", "A sentence"}, short, FilterMagicalCreatures)
+	want := []string{"Cat", "Minotaur", "A sentence"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ApplySelective() = %q, want %q", got, want)
+	}
+}
+
+// levenshtein returns the number of single-rune insertions, deletions and substitutions needed to turn a into b.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+
+	return prev[len(rb)]
+}
+
+func TestFilterDiverse(t *testing.T) {
+	// Similarity is normalized edit distance: 1 for identical records, 0 for completely different ones.
+	similarity := func(a, b string) float64 {
+		longest := max(utf8.RuneCountInString(a), utf8.RuneCountInString(b))
+		if longest == 0 {
+			return 1
+		}
+		return 1 - float64(levenshtein(a, b))/float64(longest)
+	}
+	records := []string{"kitten", "sitten", "sitting", "kitten", "apple"}
+
+	tests := []struct {
+		maxSim float64
+		want   []string
+	}{
+		// "sitten" is 1 edit from "kitten" (similarity 5/6), "sitting" is 3 edits away (4/7).
+		{0.8, []string{"kitten", "sitting", "apple"}},
+		{0.5, []string{"kitten", "apple"}},
+		// Identical records have similarity 1, which never exceeds a maxSim of 1.
+		{1, records},
+	}
+
+	for _, tt := range tests {
+		if got := FilterDiverse(similarity, tt.maxSim)(records); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("FilterDiverse(%v) = %q, want %q", tt.maxSim, got, tt.want)
+		}
+	}
+}
+
+func TestApplyParseFilters(t *testing.T) {
+	trim := func(s string) (string, bool) { return strings.TrimSpace(s), true }
+	nonEmpty := func(s string) (string, bool) { return s, s != "" }
+	upper := func(s string) (string, bool) { return strings.ToUpper(s), true }
+
+	got := ApplyParseFilters([]string{" cat ", "   ", "Dog"}, trim, nonEmpty, upper)
+	want := []string{"CAT", "DOG"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ApplyParseFilters() = %q, want %q", got, want)
+	}
+}
+
+func TestFilterMinEntropy(t *testing.T) {
+	tests := []struct {
+		bits   float64
+		record string
+		want   bool
+	}{
+		{1, "aaaa", false},
+		{1, "abab", true},
+		{2, "abab", false},
+		{2, "abcd", true},
+		{0.5, "", false},
+		{0, "", true},
+	}
+
+	for _, tt := range tests {
+		if got := FilterMinEntropy(tt.bits)(tt.record); got != tt.want {
+			t.Errorf("FilterMinEntropy(%v)(%q) = %v, want %v", tt.bits, tt.record, got, tt.want)
+		}
+	}
+}
+
+func TestFilterQuorum(t *testing.T) {
+	short := func(s string) bool { return len(s) <= 3 }
+	filters := []Filter{FilterMagicalCreatures, FilterWords, short}
+
+	tests := []struct {
+		k      int
+		record string
+		want   bool
+	}{
+		{3, "Cat", true},
+		{3, "Elephant", false},
+		{2, "Elephant", true},
+		{2, "Dragon", false},
+		{1, "Dragon", true},
+		{1, "A magical sentence", true},
+		{0, "anything", true},
+	}
+
+	for _, tt := range tests {
+		if got := FilterQuorum(tt.k, filters...)(tt.record); got != tt.want {
+			t.Errorf("FilterQuorum(%d)(%q) = %v, want %v", tt.k, tt.record, got, tt.want)
+		}
+	}
+}
+
+func TestSplitTrainTest(t *testing.T) {
+	records := make([]string, 1000)
+	for i := range records {
+		records[i] = "record-" + strconv.Itoa(i)
+	}
+
+	train, test := SplitTrainTest(records, 0.2, 42)
+	if len(train)+len(test) != len(records) {
+		t.Fatalf("SplitTrainTest() split %d records into %d and %d", len(records), len(train), len(test))
+	}
+	if len(test) < 150 || len(test) > 250 {
+		t.Errorf("SplitTrainTest(0.2) put %d of 1000 records in test, want roughly 200", len(test))
+	}
+
+	train2, test2 := SplitTrainTest(records, 0.2, 42)
+	if !reflect.DeepEqual(train, train2) || !reflect.DeepEqual(test, test2) {
+		t.Error("SplitTrainTest() with the same seed gave a different split")
+	}
+	if _, other := SplitTrainTest(records, 0.2, 7); reflect.DeepEqual(test, other) {
+		t.Error("SplitTrainTest() with a different seed gave the same split")
+	}
+}
+
+func TestQuotaFilter(t *testing.T) {
+	q := NewQuotaFilter(5)
+
+	if got, want := q.Filter([]string{"a", "b", "c"}), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("first batch = %q, want %q", got, want)
+	}
+	if got, want := q.Filter([]string{"d", "e", "f"}), []string{"d", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("second batch = %q, want %q", got, want)
+	}
+	if got := q.Filter([]string{"g"}); len(got) != 0 {
+		t.Errorf("batch after the quota = %q, want no records", got)
+	}
+	if r := q.Remaining(); r != 0 {
+		t.Errorf("Remaining() = %d, want 0", r)
+	}
+}
+
+func TestFilterSubstrings(t *testing.T) {
+	records := []string{"cat", "concatenate", "dog", "dog", "do", "bird"}
+	want := []string{"concatenate", "dog", "dog", "bird"}
+
+	if got := FilterSubstrings()(records); !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterSubstrings() = %q, want %q", got, want)
+	}
+}
+
+func TestChain(t *testing.T) {
+	order := []string{}
+	trace := func(name string) Middleware {
+		return func(f Filter) Filter {
+			return func(record string) bool {
+				order = append(order, name)
+				return f(record)
+			}
+		}
+	}
+	negate := func(f Filter) Filter {
+		return func(record string) bool { return !f(record) }
+	}
+
+	f := Chain(FilterMagicalCreatures, trace("outer"), trace("inner"), negate)
+	if !f("Dragon") || f("Cat") {
+		t.Error("Chain() didn't apply the middleware to the filter")
+	}
+	if want := []string{"outer", "inner", "outer", "inner"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("Chain() ran middleware in order %q, want %q", order, want)
+	}
+
+	if plain := Chain(FilterWords); !plain("Cat") || plain("A sentence") {
+		t.Error("Chain() with no middleware changed the filter")
+	}
+}
+
+func TestFilterJSONSchema(t *testing.T) {
+	schema := `{
+		"$defs": {"tag": {"type": "string", "pattern": "^[a-z]+$"}},
+		"type": "object",
+		"required": ["id"],
+		"properties": {
+			"id": {"type": "integer", "minimum": 1},
+			"kind": {"enum": ["animal", "id"]},
+			"tags": {"type": "array", "items": {"$ref": "#/$defs/tag"}}
+		},
+		"additionalProperties": false
+	}`
+	fb, err := FilterJSONSchema(schema)
+	if err != nil {
+		t.Fatalf("FilterJSONSchema() error = %v", err)
+	}
+
+	tests := []struct {
+		record string
+		want   bool
+	}{
+		{`{"id": 1}`, true},
+		{`{"id": 1, "tags": ["cat"], "kind": "animal"}`, true},
+		{`{"name": "Cat"}`, false},
+		{`{"id": 0}`, false},
+		{`{"id": 1.5}`, false},
+		{`{"id": 1, "tags": ["Cat"]}`, false},
+		{`{"id": 1, "kind": "plant"}`, false},
+		{`{"id": 1, "extra": true}`, false},
+		{`[1, 2]`, false},
+		{`not json`, false},
+	}
+	for _, tt := range tests {
+		if got := len(fb([]string{tt.record})) == 1; got != tt.want {
+			t.Errorf("FilterJSONSchema() kept %s = %v, want %v", tt.record, got, tt.want)
+		}
+	}
+
+	// An empty enum allows no values, so nothing validates.
+	none, err := FilterJSONSchema(`{"enum": []}`)
+	if err != nil {
+		t.Fatalf("FilterJSONSchema() of an empty enum error = %v", err)
+	}
+	if got := none([]string{`1`, `"Cat"`, `{}`}); len(got) != 0 {
+		t.Errorf("FilterJSONSchema() with an empty enum = %q, want no records", got)
+	}
+
+	for _, bad := range []string{`{"type": 1}`, `{"$ref": "#/$defs/missing"}`, `not json`} {
+		if _, err := FilterJSONSchema(bad); err == nil {
+			t.Errorf("FilterJSONSchema(%q) error = nil, want an error", bad)
+		}
+	}
+}
+
+func TestPage(t *testing.T) {
+	records := []string{"a", "b", "c", "d", "e"}
+
+	tests := []struct {
+		size, num int
+		want      []string
+		wantMore  bool
+	}{
+		{2, 1, []string{"a", "b"}, true},
+		{2, 3, []string{"e"}, false},
+		{5, 1, records, false},
+		{2, 4, []string{}, false},
+		{0, 1, []string{}, false},
+		{2, 0, []string{}, false},
+	}
+
+	for _, tt := range tests {
+		got, more := Page(records, tt.size, tt.num)
+		if !reflect.DeepEqual(got, tt.want) || more != tt.wantMore {
+			t.Errorf("Page(%d, %d) = %q, %v, want %q, %v", tt.size, tt.num, got, more, tt.want, tt.wantMore)
+		}
+	}
+}
+
+func TestScoreRecords(t *testing.T) {
+	filters := []NamedFilter{
+		{Name: "magical", Filter: FilterMagicalCreatures},
+		{Name: "words", Filter: FilterWords},
+	}
+
+	// "A Dragon" mentions a dragon and is more than one word, so it fails both of these.
+	strict := []NamedFilter{
+		{Name: "no dragons", Filter: func(s string) bool { return !strings.Contains(s, "Dragon") }},
+		{Name: "words", Filter: FilterWords},
+	}
+	if got := ScoreRecords([]string{"A Dragon"}, strict...); !reflect.DeepEqual(got, []RecordScore{{"A Dragon", 0}}) {
+		t.Errorf("ScoreRecords() of a record failing every filter = %v, want a score of 0", got)
+	}
+
+	got := ScoreRecords([]string{"Cat", "Dragon", "A magical sentence"}, filters...)
+	want := []RecordScore{{"Cat", 1}, {"Dragon", 0.5}, {"A magical sentence", 0.5}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ScoreRecords() = %v, want %v", got, want)
+	}
+
+	if got := ScoreRecords([]string{"Cat"}); !reflect.DeepEqual(got, []RecordScore{{"Cat", 1}}) {
+		t.Errorf("ScoreRecords() with no filters = %v, want a score of 1", got)
+	}
+}
+
+func TestIncrementalFilter(t *testing.T) {
+	f := NewIncrementalFilter(FilterMagicalCreatures, FilterWords)
+
+	if got, want := f.Append([]string{"Cat", "Dragon", "Dog"}), []string{"Cat", "Dog"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("first Append() = %q, want %q", got, want)
+	}
+	if got, want := f.Append([]string{"Cat", "A sentence", "Owl"}), []string{"Owl"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("second Append() = %q, want %q", got, want)
+	}
+}
+
+func TestTruncateToBytes(t *testing.T) {
+	got := TruncateToBytes(10)(sampleRecords)
+	if len(got) != len(sampleRecords) {
+		t.Fatalf("TruncateToBytes(10) returned %d records, want all %d", len(got), len(sampleRecords))
+	}
+	for i, r := range got {
+		if len(r) > 10 || !strings.HasPrefix(sampleRecords[i], r) {
+			t.Errorf("TruncateToBytes(10)[%d] = %q, want a prefix of %q of at most 10 bytes", i, r, sampleRecords[i])
+		}
+	}
+
+	tests := []struct {
+		max    int
+		record string
+		want   string
+	}{
+		// "é" is two bytes, so cutting inside it backs off to the previous character.
+		{2, "aé", "a"},
+		{3, "aéb", "aé"},
+		{2, "日本", ""},
+		{3, "日本", "日"},
+		{0, "Cat", ""},
+	}
+	for _, tt := range tests {
+		got := TruncateToBytes(tt.max)([]string{tt.record})
+		if got[0] != tt.want || !utf8.ValidString(got[0]) {
+			t.Errorf("TruncateToBytes(%d)(%q) = %q, want %q", tt.max, tt.record, got[0], tt.want)
+		}
+	}
+}
+
+func TestTieBreaker(t *testing.T) {
+	// Every record has the same length, so the order is decided entirely by the tie breaker.
+	records := []string{"bb", "aa", "cc", "dd"}
+
+	tests := []struct {
+		tb   TieBreaker
+		want []string
+	}{
+		{ByIndex, []string{"bb", "aa", "cc", "dd"}},
+		{ByLexical, []string{"aa", "bb", "cc", "dd"}},
+	}
+	for _, tt := range tests {
+		if got := FilterLongest(4, tt.tb)(records); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("FilterLongest(4, %d) = %q, want %q", tt.tb, got, tt.want)
+		}
+	}
+
+	byHash := FilterLongest(4, ByHash)(records)
+	if !reflect.DeepEqual(byHash, FilterLongest(4, ByHash)(records)) {
+		t.Error("FilterLongest(4, ByHash) isn't deterministic")
+	}
+	want := append([]string{}, records...)
+	sort.Slice(want, func(i, j int) bool { return hashRecord(want[i]) < hashRecord(want[j]) })
+	if !reflect.DeepEqual(byHash, want) {
+		t.Errorf("FilterLongest(4, ByHash) = %q, want %q", byHash, want)
+	}
+
+	if got, want := FilterMostFrequent(2, ByLexical)([]string{"b", "a", "c", "a", "b"}), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterMostFrequent(2, ByLexical) = %q, want %q", got, want)
+	}
+}
+
+func TestFilterDenyPatternsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deny.txt")
+	if err := os.WriteFile(path, []byte("^\\d+$\n\n(?i)dragon\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	fb, err := FilterDenyPatternsFile(path)
+	if err != nil {
+		t.Fatalf("FilterDenyPatternsFile() error = %v", err)
+	}
+	if got, want := fb([]string{"Cat", "12", "DRAGON", "a12"}), []string{"Cat", "a12"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterDenyPatternsFile() = %q, want %q", got, want)
+	}
+
+	bad := filepath.Join(t.TempDir(), "bad.txt")
+	if err := os.WriteFile(bad, []byte("ok\n(unclosed\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FilterDenyPatternsFile(bad); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("FilterDenyPatternsFile() error = %v, want one naming line 2", err)
+	}
+	if _, err := FilterDenyPatternsFile(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("FilterDenyPatternsFile() of a missing file error = nil, want an error")
+	}
+}
+
+func TestWithMetrics(t *testing.T) {
+	var m Metrics
+	magical := Chain(FilterMagicalCreatures, m.CountRejections("magical"))
+	words := Chain(FilterWords, m.CountRejections("words"))
+	sets := map[string]FilterSet{
+		"magical": WithMetrics(func(records []string) []string { return ApplyFilters(records, magical) }, &m),
+		"both":    WithMetrics(func(records []string) []string { return ApplyFilters(records, magical, words) }, &m),
+	}
+
+	// Run the sets concurrently, several times over, so -race sees shared updates.
+	const runs = 10
+	var wg sync.WaitGroup
+	for i := 0; i < runs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ClassifyParallel(sampleRecords, sets)
+			m.RejectedByFilter()
+		}()
+	}
+	wg.Wait()
+
+	if got, want := m.RecordsIn.Load(), int64(runs*len(sets)*len(sampleRecords)); got != want {
+		t.Errorf("RecordsIn = %d, want %d", got, want)
+	}
+	// The magical set keeps 5 of the 7 sample records, and the set of both filters keeps 4.
+	if got, want := m.RecordsOut.Load(), int64(runs*(5+4)); got != want {
+		t.Errorf("RecordsOut = %d, want %d", got, want)
+	}
+
+	// Both sets reject "Minotaur" and "Dragon" as magical, and each rejection is counted once.
+	want := map[string]int64{"magical": runs * 2 * 2, "words": runs}
+	if got := m.RejectedByFilter(); !reflect.DeepEqual(got, want) {
+		t.Errorf("RejectedByFilter() = %v, want %v", got, want)
+	}
+	if got := m.Rejected("magical"); got != want["magical"] {
+		t.Errorf("Rejected(\"magical\") = %d, want %d", got, want["magical"])
+	}
+
+	// The snapshot is a copy, so changing it doesn't affect the counters.
+	snapshot := m.RejectedByFilter()
+	snapshot["magical"] = -1
+	if got := m.Rejected("magical"); got != want["magical"] {
+		t.Errorf("Rejected(\"magical\") after editing a snapshot = %d, want %d", got, want["magical"])
+	}
+}
+
+func TestMetricsCountRejections(t *testing.T) {
+	var m Metrics
+	magical := Chain(FilterMagicalCreatures, m.CountRejections("magical"))
+	words := Chain(FilterWords, m.CountRejections("words"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ApplyFilters(sampleRecords, magical, words)
+		}()
+	}
+	wg.Wait()
+
+	// Each run rejects "Minotaur" and "Dragon" as magical, and "A sentence is not a valid record." as not a word.
+	want := map[string]int64{"magical": 8, "words": 4}
+	if got := m.RejectedByFilter(); !reflect.DeepEqual(got, want) {
+		t.Errorf("RejectedByFilter() = %v, want %v", got, want)
+	}
+}
+
+func TestFilterMergeVersioned(t *testing.T) {
+	pattern := regexp.MustCompile(` \((\d+)\)$`)
+	records := []string{"report.txt", "notes (2)", "report.txt (3)", "notes", "report.txt (2)", "draft (x)"}
+	want := []string{"report.txt (3)", "notes (2)", "draft (x)"}
+
+	if got := FilterMergeVersioned(pattern)(records); !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterMergeVersioned() = %q, want %q", got, want)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestTeeFilter(t *testing.T) {
+	var a, b bytes.Buffer
+	got, err := TeeFilter(sampleRecords, []Filter{FilterMagicalCreatures, FilterWords}, &a, &b)
+	want := ApplyFilters(sampleRecords, FilterMagicalCreatures, FilterWords)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("TeeFilter() = %q, %v, want %q", got, err, want)
+	}
+
+	written := strings.Join(want, "\n") + "\n"
+	if a.String() != written || b.String() != written {
+		t.Errorf("TeeFilter() wrote %q and %q, want %q to each", a.String(), b.String(), written)
+	}
+
+	if _, err := TeeFilter(sampleRecords, nil, &a, failingWriter{}); err == nil {
+		t.Error("TeeFilter() error = nil, want the write error")
+	}
+}
+
+func TestFilterTimeWindow(t *testing.T) {
+	extract := func(record string) (time.Time, bool) {
+		ts, _, _ := strings.Cut(record, " ")
+		parsed, err := time.Parse(time.RFC3339, ts)
+		return parsed, err == nil
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	records := []string{
+		"2023-12-31T23:59:59Z before",
+		"2024-01-01T00:00:00Z start",
+		"2024-01-15T12:00:00Z middle",
+		"2024-02-01T00:00:00Z end",
+		"no timestamp",
+	}
+	want := []string{"2024-01-01T00:00:00Z start", "2024-01-15T12:00:00Z middle"}
+
+	if got := FilterTimeWindow(extract, start, end)(records); !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterTimeWindow() = %q, want %q", got, want)
+	}
+}
+
+func TestOptimizeOrder(t *testing.T) {
+	slow := func(s string) bool {
+		time.Sleep(100 * time.Microsecond)
+		return s != "Dragon"
+	}
+	never := func(string) bool { return true }
+	filters := []NamedFilter{
+		{Name: "never", Filter: never},
+		{Name: "slow", Filter: slow},
+		{Name: "words", Filter: FilterWords},
+	}
+
+	records := []string{"Cat", "A sentence", "Another sentence", "Dragon", "Dog"}
+	ordered := OptimizeOrder(records, filters)
+
+	names := []string{}
+	for _, f := range ordered {
+		names = append(names, f.Name)
+	}
+	if want := []string{"words", "slow", "never"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("OptimizeOrder() = %q, want %q", names, want)
+	}
+	if got, want := ApplyNamedFilters(records, ordered...), ApplyNamedFilters(records, filters...); !reflect.DeepEqual(got, want) {
+		t.Errorf("ApplyNamedFilters() with the optimized order = %q, want %q", got, want)
+	}
+}
+
+func TestTopKPerGroup(t *testing.T) {
+	firstLetter := func(s string) string { return s[:1] }
+	records := []string{"cow", "bee", "cat", "bear", "crow", "bat", "camel"}
+
+	tests := []struct {
+		name string
+		k    int
+		want []string
+	}{
+		{"k=1", 1, []string{"camel", "bear"}},
+		{"k=2", 2, []string{"camel", "crow", "bear", "bee"}},
+		{"k=3 ties keep input order", 3, []string{"camel", "crow", "cow", "bear", "bee", "bat"}},
+		{"k=0", 0, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TopKPerGroup(firstLetter, tt.k)(records); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TopKPerGroup(%d) = %q, want %q", tt.k, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterSetConfig(t *testing.T) {
+	valid := FilterSetConfig{
+		Filters: []NamedFilter{{Name: "magical", Filter: FilterMagicalCreatures}, {Name: "words", Filter: FilterWords}},
+		Bulk:    []FilterBulk{FilterDuplicates},
+		Canary:  "Cat",
+	}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Validate() error = %v, want nil", err)
+	}
+	if got, want := valid.FilterSet()(sampleRecords), ApplyBulkFilters(ApplyFilters(sampleRecords, FilterMagicalCreatures, FilterWords), FilterDuplicates); !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterSet() = %q, want %q", got, want)
+	}
+
+	broken := FilterSetConfig{
+		Filters: []NamedFilter{{Name: "nil"}, {Name: "panics", Filter: func(s string) bool { return s[10] == 'x' }}},
+		Bulk:    []FilterBulk{nil, FilterDuplicates},
+		Canary:  "Cat",
+	}
+	err := broken.Validate()
+	if joined, ok := err.(interface{ Unwrap() []error }); !ok || len(joined.Unwrap()) != 3 {
+		t.Errorf("Validate() error = %v, want 3 joined errors", err)
+	}
+}
+
+func TestFilterHammingDedup(t *testing.T) {
+	records := []string{"karolin", "kathrin", "kerstin", "karolyn", "cat", "car", "cart"}
+
+	tests := []struct {
+		maxDistance int
+		want        []string
+	}{
+		{0, records},
+		{1, []string{"karolin", "kathrin", "kerstin", "cat", "cart"}},
+		{3, []string{"karolin", "cat", "cart"}},
+	}
+
+	for _, tt := range tests {
+		if got := FilterHammingDedup(tt.maxDistance)(records); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("FilterHammingDedup(%d) = %q, want %q", tt.maxDistance, got, tt.want)
+		}
+	}
+}
+
+func TestAdaptiveFilter(t *testing.T) {
+	strict := func(s string) bool { return s == "Cat" }
+	relaxed := FilterWords
+
+	tests := []struct {
+		name    string
+		records []string
+		want    []string
+	}{
+		{"strict within threshold", []string{"Cat", "Cat", "Dog"}, []string{"Cat", "Cat"}},
+		{"falls back to relaxed", []string{"Cat", "Dog", "Owl", "A sentence"}, []string{"Cat", "Dog", "Owl"}},
+		{"empty batch", []string{}, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AdaptiveFilter(strict, relaxed, 0.5)(tt.records); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AdaptiveFilter() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterDedupPaths(t *testing.T) {
+	records := []string{"a/b/../c", "a/c", "./a/c/", "/a/c", "a//c", "d"}
+	want := []string{"a/b/../c", "/a/c", "d"}
+
+	if got := FilterDedupPaths()(records); !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterDedupPaths() = %q, want %q", got, want)
+	}
+}
+
+func TestCaptureReplay(t *testing.T) {
+	r := Capture(FilterForAnimals, sampleRecords)
+	if !reflect.DeepEqual(r.Input, sampleRecords) || !reflect.DeepEqual(r.Output, FilterForAnimals(sampleRecords)) {
+		t.Fatalf("Capture() = %+v, want the sample input and its filtered output", r)
+	}
+
+	// A recording survives a JSON round trip, so it can be stored as a golden file.
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var golden Recording
+	if err := json.Unmarshal(data, &golden); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AssertReplay(golden, FilterForAnimals); err != nil {
+		t.Errorf("AssertReplay() with the same filter set error = %v, want nil", err)
+	}
+	if err := AssertReplay(golden, FilterForIDs); err == nil {
+		t.Error("AssertReplay() with a different filter set error = nil, want an error")
+	}
+}
+
+func TestRequireMinPrefixes(t *testing.T) {
+	records := []string{"cat", "cow", "dog", "d"}
+
+	tests := []struct {
+		prefixLen, min int
+		wantErr        bool
+	}{
+		{1, 2, false},
+		{1, 3, true},
+		// "d" is shorter than the prefix, so it is its own prefix.
+		{2, 4, false},
+		{2, 5, true},
+	}
+
+	for _, tt := range tests {
+		got, err := RequireMinPrefixes(tt.prefixLen, tt.min)(records)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("RequireMinPrefixes(%d, %d) error = %v, wantErr %v", tt.prefixLen, tt.min, err, tt.wantErr)
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, records) {
+			t.Errorf("RequireMinPrefixes(%d, %d) = %q, want records unchanged", tt.prefixLen, tt.min, got)
+		}
+	}
+}
+
+func TestFilterTopWeighted(t *testing.T) {
+	length := func(s string) float64 { return float64(len(s)) }
+	records := []string{"dd", "a", "ccc", "bb", "eee"}
+
+	tests := []struct {
+		name string
+		n    int
+		want []string
+	}{
+		{"keeps heaviest in input order", 2, []string{"ccc", "eee"}},
+		{"ties go to the earlier record", 3, []string{"dd", "ccc", "eee"}},
+		{"n larger than input", 10, records},
+		{"negative n", -1, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FilterTopWeighted(length, tt.n)(records); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FilterTopWeighted(%d) = %q, want %q", tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterAnagramDedup(t *testing.T) {
+	records := []string{"Cat", "act", "tac", "listen", "silent", "dog"}
+
+	tests := []struct {
+		caseInsensitive bool
+		want            []string
+	}{
+		{false, []string{"Cat", "act", "listen", "dog"}},
+		{true, []string{"Cat", "listen", "dog"}},
+	}
+
+	for _, tt := range tests {
+		if got := FilterAnagramDedup(tt.caseInsensitive)(records); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("FilterAnagramDedup(%v) = %q, want %q", tt.caseInsensitive, got, tt.want)
+		}
+	}
+}
+
+func TestMemoFilter(t *testing.T) {
+	var calls atomic.Int64
+	f := MemoFilter(func(record string) bool {
+		calls.Add(1)
+		return FilterWords(record)
+	})
+
+	// Share the memoized filter across the sets of one parallel run, as the doc comment suggests.
+	sets := map[string]FilterSet{}
+	for _, name := range []string{"a", "b", "c"} {
+		sets[name] = func(records []string) []string { return ApplyFilters(records, f) }
+	}
+	got := ClassifyParallel(sampleRecords, sets)
+
+	want := ApplyFilters(sampleRecords, FilterWords)
+	for name, kept := range got {
+		if !reflect.DeepEqual(kept, want) {
+			t.Errorf("set %q kept %q, want %q", name, kept, want)
+		}
+	}
+
+	// Every repeated record is evaluated once, even when the sets run concurrently.
+	if n, distinct := calls.Load(), int64(len(toSet(sampleRecords))); n != distinct {
+		t.Errorf("MemoFilter() evaluated the filter %d times, want %d", n, distinct)
+	}
+
+	calls.Store(0)
+	f("Cat")
+	if n := calls.Load(); n != 0 {
+		t.Errorf("MemoFilter() evaluated a cached record %d times, want 0", n)
+	}
+}
+
+func TestEnsureSortedBy(t *testing.T) {
+	key := func(s string) string { return strings.ToLower(s) }
+	unsorted := []string{"b", "A", "c", "a"}
+
+	if _, err := EnsureSortedBy(key, false)(unsorted); err == nil {
+		t.Error("EnsureSortedBy(autoSort=false) error = nil for unsorted records")
+	}
+
+	sorted := []string{"A", "a", "b", "c"}
+	if got, err := EnsureSortedBy(key, false)(sorted); err != nil || !reflect.DeepEqual(got, sorted) {
+		t.Errorf("EnsureSortedBy(autoSort=false) = %q, %v, want records unchanged", got, err)
+	}
+
+	// Auto-sorting is stable, so "A" stays before "a", and the input isn't modified.
+	got, err := EnsureSortedBy(key, true)(unsorted)
+	if want := []string{"A", "a", "b", "c"}; err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("EnsureSortedBy(autoSort=true) = %q, %v, want %q", got, err, want)
+	}
+	if want := []string{"b", "A", "c", "a"}; !reflect.DeepEqual(unsorted, want) {
+		t.Errorf("EnsureSortedBy(autoSort=true) modified its input to %q", unsorted)
+	}
+}
+
+func TestDecisionBitmap(t *testing.T) {
+	bitmap := DecisionBitmap(sampleRecords, FilterMagicalCreatures, FilterWords)
+
+	for i, r := range sampleRecords {
+		want := passesFilters(r, FilterMagicalCreatures, FilterWords)
+		if got := bitmap.Bit(i) == 1; got != want {
+			t.Errorf("DecisionBitmap() bit %d (%q) = %v, want %v", i, r, got, want)
+		}
+	}
+
+	if got := DecisionBitmap([]string{}, FilterWords); got.Sign() != 0 {
+		t.Errorf("DecisionBitmap() of no records = %v, want 0", got)
+	}
+}
+
+func TestRewriteRecords(t *testing.T) {
+	table := map[string]string{"Kitty": "Cat", "Puppy": "Dog"}
+	got := RewriteRecords(table)([]string{"Kitty", "Owl", "Puppy", "Cat"})
+	want := []string{"Cat", "Owl", "Dog", "Cat"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("RewriteRecords() = %q, want %q", got, want)
+	}
+
+	// The rewritten alias then dedups with its canonical form, leaving a single "Cat".
+	deduped := ApplyBulkFilters([]string{"Kitty", "Cat", "Owl"}, RewriteRecords(table), FilterDuplicates)
+	if want := []string{"Cat", "Owl"}; !reflect.DeepEqual(deduped, want) {
+		t.Errorf("RewriteRecords() then FilterDuplicates = %q, want %q", deduped, want)
+	}
+}
+
+func TestBulkIf(t *testing.T) {
+	large := func(records []string) bool { return len(records) > 3 }
+	f := BulkIf(large, FilterDuplicates)
+
+	if got, want := f(sampleRecords), FilterDuplicates(sampleRecords); !reflect.DeepEqual(got, want) {
+		t.Errorf("BulkIf() on a large batch = %q, want %q", got, want)
+	}
+
+	small := []string{"Cat", "Cat"}
+	if got := f(small); !reflect.DeepEqual(got, small) {
+		t.Errorf("BulkIf() on a small batch = %q, want records unchanged", got)
+	}
+}
+
+func TestFilterCSVFieldCount(t *testing.T) {
+	records := []string{
+		"a,b,c",
+		`"a,b",c,d`,
+		"a,b",
+		`"a,b,c`,
+		"a,b,c\nd,e,f",
+		`"a ""quoted"" field",b,c`,
+	}
+	want := []string{"a,b,c", `"a,b",c,d`, `"a ""quoted"" field",b,c`}
+
+	if got := FilterCSVFieldCount(3)(records); !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterCSVFieldCount(3) = %q, want %q", got, want)
+	}
+}
+
+func TestFilterLengthPercentile(t *testing.T) {
+	records := []string{"a", "bb", "ccc", "dddd", "eeeee"}
+
+	tests := []struct {
+		low, high float64
+		want      []string
+	}{
+		{0, 100, records},
+		{25, 75, []string{"bb", "ccc", "dddd"}},
+		// The 10th percentile interpolates to 1.4, so "a" is dropped.
+		{10, 50, []string{"bb", "ccc"}},
+		{-10, 200, records},
+	}
+
+	for _, tt := range tests {
+		if got := FilterLengthPercentile(tt.low, tt.high)(records); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("FilterLengthPercentile(%v, %v) = %q, want %q", tt.low, tt.high, got, tt.want)
+		}
+	}
+
+	if got := FilterLengthPercentile(0, 100)([]string{}); len(got) != 0 {
+		t.Errorf("FilterLengthPercentile() of no records = %q, want none", got)
+	}
+}